@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Metrics the built-in metric source knows about. Criteria may name any
+// metric, unknown ones count as 0
+const (
+	MetricEmailVerified = "email_verified"
+	MetricTwoFactor     = "two_factor"
+	MetricPasskeys      = "passkeys"
+	MetricRoomsCreated  = "rooms_created"
+	MetricRoomsJoined   = "rooms_joined"
+	MetricMessagesSent  = "messages_sent"
+	MetricActiveDays    = "active_days"
+	MetricStreakDays    = "streak_days"
+)
+
+// criterionClause is one comparison like "messages_sent >= 100"
+type criterionClause struct {
+	Metric string
+	Op     string
+	Value  int64
+}
+
+// Criteria is a list of clauses that must all hold
+type Criteria []criterionClause
+
+var clausePattern = regexp.MustCompile(`^\s*([a-z][a-z0-9_]*)\s*(>=|<=|==|!=|>|<)\s*(-?\d+)\s*$`)
+
+// parseCriteria parses expressions like "rooms_created >= 5 && streak_days >= 7".
+// Clauses are joined with && or "and"
+func parseCriteria(expr string) (Criteria, error) {
+	var criteria Criteria
+	for _, part := range strings.Split(strings.ReplaceAll(expr, " and ", " && "), "&&") {
+		m := clausePattern.FindStringSubmatch(part)
+		if m == nil {
+			return nil, fmt.Errorf("invalid clause %q", strings.TrimSpace(part))
+		}
+		value, err := strconv.ParseInt(m[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number in %q", strings.TrimSpace(part))
+		}
+		criteria = append(criteria, criterionClause{Metric: m[1], Op: m[2], Value: value})
+	}
+	return criteria, nil
+}
+
+// Metrics returns the metrics the criteria read
+func (cr Criteria) Metrics() []string {
+	names := make([]string, 0, len(cr))
+	for _, clause := range cr {
+		names = append(names, clause.Metric)
+	}
+	return names
+}
+
+func (cr Criteria) uses(metric string) bool {
+	for _, clause := range cr {
+		if clause.Metric == metric {
+			return true
+		}
+	}
+	return false
+}
+
+func (cr Criteria) Eval(values map[string]int64) bool {
+	for _, clause := range cr {
+		v := values[clause.Metric]
+		var ok bool
+		switch clause.Op {
+		case ">=":
+			ok = v >= clause.Value
+		case ">":
+			ok = v > clause.Value
+		case "<=":
+			ok = v <= clause.Value
+		case "<":
+			ok = v < clause.Value
+		case "==":
+			ok = v == clause.Value
+		case "!=":
+			ok = v != clause.Value
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// catalogEntry is an achievement as written in the catalog file
+type catalogEntry struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Criteria    string `json:"criteria"`
+}
+
+type catalogAchievement struct {
+	Achievement
+	criteria Criteria
+}
+
+// achievementCatalog is a parsed catalog file. It is never modified after
+// loading, reloads swap in a new one
+type achievementCatalog struct {
+	achievements []catalogAchievement
+	byID         map[string]*catalogAchievement
+}
+
+// loadAchievementCatalog reads a JSON array of catalog entries
+func loadAchievementCatalog(path string) (*achievementCatalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []catalogEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	catalog := &achievementCatalog{
+		achievements: make([]catalogAchievement, 0, len(entries)),
+		byID:         make(map[string]*catalogAchievement, len(entries)),
+	}
+	for _, e := range entries {
+		if e.ID == "" || e.Name == "" {
+			return nil, fmt.Errorf("%s: achievements need an id and a name", path)
+		}
+		if _, dup := catalog.byID[e.ID]; dup {
+			return nil, fmt.Errorf("%s: duplicate achievement %q", path, e.ID)
+		}
+		criteria, err := parseCriteria(e.Criteria)
+		if err != nil {
+			return nil, fmt.Errorf("%s: achievement %q: %w", path, e.ID, err)
+		}
+		catalog.achievements = append(catalog.achievements, catalogAchievement{
+			Achievement: Achievement{ID: e.ID, Name: e.Name, Description: e.Description},
+			criteria:    criteria,
+		})
+	}
+	for i := range catalog.achievements {
+		catalog.byID[catalog.achievements[i].ID] = &catalog.achievements[i]
+	}
+	return catalog, nil
+}
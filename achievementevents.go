@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AchievementEvent tells the evaluator that some metrics of a user changed
+type AchievementEvent struct {
+	UserID  uint
+	Metrics []string
+}
+
+// achievementEvents is buffered so the hub and handlers never wait on the
+// evaluator
+var achievementEvents = make(chan AchievementEvent, 1024)
+
+// maxAchievementBatch caps how many queued events are merged per evaluation
+const maxAchievementBatch = 256
+
+// publishAchievementEvent queues an event for the evaluator. When the queue
+// is full the event is dropped, the next event for the user checks the same
+// criteria again
+func publishAchievementEvent(userID uint, metrics ...string) {
+	select {
+	case achievementEvents <- AchievementEvent{UserID: userID, Metrics: metrics}:
+	default:
+	}
+}
+
+// runAchievementEvaluator consumes achievement events. Events queued for the
+// same user are merged so a burst of messages is checked once
+func runAchievementEvaluator(db *gorm.DB, service AchievementService, events <-chan AchievementEvent) {
+	for event := range events {
+		pending := map[uint]map[string]bool{}
+		merge := func(e AchievementEvent) {
+			if pending[e.UserID] == nil {
+				pending[e.UserID] = make(map[string]bool)
+			}
+			for _, m := range e.Metrics {
+				pending[e.UserID][m] = true
+			}
+		}
+		merge(event)
+
+	drain:
+		for i := 0; i < maxAchievementBatch; i++ {
+			select {
+			case e := <-events:
+				merge(e)
+			default:
+				break drain
+			}
+		}
+
+		for userID, metricSet := range pending {
+			var user User
+			if err := db.First(&user, userID).Error; err != nil {
+				continue
+			}
+			metrics := make([]string, 0, len(metricSet))
+			for m := range metricSet {
+				metrics = append(metrics, m)
+			}
+			if _, err := service.Evaluate(&user, metrics...); err != nil {
+				slog.Error("failed to evaluate achievements", "user", userID, "error", err)
+			}
+		}
+	}
+}
+
+// watchAchievementCatalog reloads the catalog whenever the file changes. A
+// broken catalog is logged and the previous one stays in use. Achievements
+// added by a reload are checked for each user on their next login or
+// connection
+func watchAchievementCatalog(service AchievementService, path string, interval time.Duration) {
+	var lastMod time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
+
+		if err := service.Reload(); err != nil {
+			slog.Error("failed to reload achievement catalog", "path", path, "error", err)
+			continue
+		}
+		slog.Info("reloaded achievement catalog", "path", path)
+	}
+}
+
+func achievementMessage(achievement Achievement) ChatMessage {
+	return ChatMessage{
+		Type:        MessageTypeAchievement,
+		Content:     "Achievement unlocked: " + achievement.Name,
+		Achievement: &achievement,
+	}
+}
+
+// notifyAchievementUnlock pushes an unlock to every connected client of the
+// user. If no client got it the unlock stays unseen and is shown on the next
+// login or connection
+func notifyAchievementUnlock(db *gorm.DB, hub *Hub, user *User, achievement Achievement) {
+	n := &Notification{
+		UserID:  user.ID,
+		Message: achievementMessage(achievement),
+		Delivered: func(clients int) {
+			if clients > 0 {
+				go markAchievementsSeen(db, user.ID, achievement.ID)
+			}
+		},
+	}
+	if user.AnnounceAchievements {
+		n.Announce = user.Username + " unlocked " + achievement.Name
+	}
+	hub.notify <- n
+}
+
+func unseenAchievements(db *gorm.DB, userID uint) ([]UserAchievement, error) {
+	unseen := []UserAchievement{}
+	err := db.Preload("Achievement").
+		Where("user_id = ? AND seen_at IS NULL", userID).
+		Order("unlocked_at").
+		Find(&unseen).Error
+	return unseen, err
+}
+
+func markAchievementsSeen(db *gorm.DB, userID uint, achievementIDs ...string) {
+	if len(achievementIDs) == 0 {
+		return
+	}
+	if err := db.Model(&UserAchievement{}).
+		Where("user_id = ? AND achievement_id IN ? AND seen_at IS NULL", userID, achievementIDs).
+		Update("seen_at", time.Now()).Error; err != nil {
+		slog.Error("failed to mark achievements seen", "user", userID, "error", err)
+	}
+}
+
+// deliverUnseenAchievements sends a newly connected client the unlocks its
+// user hasn't seen yet
+func deliverUnseenAchievements(db *gorm.DB, hub *Hub, client *Client) {
+	unseen, err := unseenAchievements(db, client.user.ID)
+	if err != nil {
+		return
+	}
+	for _, ua := range unseen {
+		achievementID := ua.AchievementID
+		hub.notify <- &Notification{
+			Client:  client,
+			Message: achievementMessage(ua.Achievement),
+			Delivered: func(clients int) {
+				if clients > 0 {
+					go markAchievementsSeen(db, client.user.ID, achievementID)
+				}
+			},
+		}
+	}
+}
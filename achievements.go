@@ -1,48 +1,324 @@
 package main
 
 import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/labstack/echo/v4"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-// todo: add a Achievements []UserAchievement `gorm:"foreignKey:UserID"` to the user struct and also make these gorm models
+var ErrUnknownAchievement = errors.New("unknown achievement")
+
 type Achievement struct {
-	ID          string
-	Name        string
-	Description string
+	ID          string    `gorm:"primaryKey;size:64" json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"-"`
+	UpdatedAt   time.Time `json:"-"`
 }
 
 type UserAchievement struct {
-	UserID        uint
-	AchievementID string
-	UnlockedAt    time.Time
+	UserID        uint        `gorm:"primaryKey" json:"-"`
+	AchievementID string      `gorm:"primaryKey;size:64" json:"achievement_id"`
+	Achievement   Achievement `gorm:"foreignKey:AchievementID" json:"achievement"`
+	UnlockedAt    time.Time   `json:"unlocked_at"`
+	SeenAt        *time.Time  `json:"seen_at"` // set once the user was shown the unlock
+}
+
+// MetricSource provides the values achievement criteria are checked against
+type MetricSource interface {
+	// Metrics returns the values of the metrics in names it knows about,
+	// unknown metrics are left out and count as 0
+	Metrics(user *User, names []string) (map[string]int64, error)
+}
+
+// multiMetricSource asks each source in turn, earlier sources win
+type multiMetricSource []MetricSource
+
+func (m multiMetricSource) Metrics(user *User, names []string) (map[string]int64, error) {
+	values := make(map[string]int64, len(names))
+	for _, source := range m {
+		v, err := source.Metrics(user, names)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range v {
+			if _, ok := values[name]; !ok {
+				values[name] = value
+			}
+		}
+	}
+	return values, nil
+}
+
+// accountMetrics reads metrics straight from the account and room tables
+type accountMetrics struct {
+	db *gorm.DB
+}
+
+func (m accountMetrics) Metrics(user *User, names []string) (map[string]int64, error) {
+	values := make(map[string]int64, len(names))
+	for _, name := range names {
+		var count int64
+		switch name {
+		case MetricEmailVerified:
+			if user.EmailVerified {
+				count = 1
+			}
+		case MetricTwoFactor:
+			if user.TOTPEnabled {
+				count = 1
+			} else {
+				m.db.Model(&PasskeyCredential{}).Where("user_id = ?", user.ID).Count(&count)
+				count = min(count, 1)
+			}
+		case MetricPasskeys:
+			m.db.Model(&PasskeyCredential{}).Where("user_id = ?", user.ID).Count(&count)
+		case MetricRoomsCreated:
+			m.db.Model(&ChatRoom{}).Where("owner_id = ?", user.ID).Count(&count)
+		case MetricRoomsJoined:
+			m.db.Model(&RoomParticipant{}).Where("user_id = ?", user.ID).Count(&count)
+		default:
+			continue
+		}
+		values[name] = count
+	}
+	return values, nil
 }
 
 type AchievementService interface {
 	CheckCriteria(user *User, achievementID string) bool
-	RewardAchievement(user *User, achievementID string) error
-	GetAchievements(user *User) ([]Achievement, error)
+	// RewardAchievement unlocks an achievement for user. Rewarding an
+	// achievement twice is not an error, the bool reports whether it was
+	// newly unlocked
+	RewardAchievement(user *User, achievementID string) (bool, error)
+	// Evaluate rewards the achievements user doesn't have yet whose criteria
+	// are met. With metrics given only achievements reading one of them are
+	// checked
+	Evaluate(user *User, metrics ...string) ([]Achievement, error)
+	GetAchievements(user *User) ([]UserAchievement, error)
+	// Reload reads the catalog file again
+	Reload() error
+	// OnUnlock sets a function called for every newly unlocked achievement
+	OnUnlock(fn func(user *User, achievement Achievement))
 }
 
 type achievementService struct {
-	db *gorm.DB
+	db          *gorm.DB
+	catalogPath string
+	catalog     atomic.Pointer[achievementCatalog]
+	metrics     MetricSource
+	onUnlock    func(user *User, achievement Achievement)
 }
 
-func NewAchievementService(db *gorm.DB) AchievementService {
-	return &achievementService{
-		db: db,
+// NewAchievementService loads the catalog at catalogPath. Criteria are
+// checked against the account metrics and then the extra sources
+func NewAchievementService(db *gorm.DB, catalogPath string, sources ...MetricSource) (AchievementService, error) {
+	s := &achievementService{
+		db:          db,
+		catalogPath: catalogPath,
+		metrics:     append(multiMetricSource{accountMetrics{db: db}}, sources...),
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
 	}
+	return s, nil
 }
+
+// Reload parses the catalog and stores its achievements. Achievements dropped
+// from the catalog stay in the database so users keep them
+func (s *achievementService) Reload() error {
+	catalog, err := loadAchievementCatalog(s.catalogPath)
+	if err != nil {
+		return err
+	}
+
+	if len(catalog.achievements) > 0 {
+		rows := make([]Achievement, 0, len(catalog.achievements))
+		for _, a := range catalog.achievements {
+			rows = append(rows, a.Achievement)
+		}
+		if err := s.db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"name", "description", "updated_at"}),
+		}).Create(&rows).Error; err != nil {
+			return err
+		}
+	}
+
+	s.catalog.Store(catalog)
+	return nil
+}
+
 func (s *achievementService) CheckCriteria(user *User, achievementID string) bool {
-	// Check if the user meets the criteria for the achievement
-	return true
+	a, ok := s.catalog.Load().byID[achievementID]
+	if !ok {
+		return false
+	}
+	values, err := s.metrics.Metrics(user, a.criteria.Metrics())
+	if err != nil {
+		return false
+	}
+	return a.criteria.Eval(values)
 }
 
-func (s *achievementService) RewardAchievement(user *User, achievementID string) error {
-	return nil
+func (s *achievementService) RewardAchievement(user *User, achievementID string) (bool, error) {
+	var achievement Achievement
+	if err := s.db.First(&achievement, "id = ?", achievementID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, ErrUnknownAchievement
+		}
+		return false, err
+	}
+
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&UserAchievement{
+		UserID:        user.ID,
+		AchievementID: achievementID,
+		UnlockedAt:    time.Now(),
+	})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+
+	if s.onUnlock != nil {
+		s.onUnlock(user, achievement)
+	}
+	return true, nil
 }
-func (s *achievementService) GetAchievements(user *User) ([]Achievement, error) {
-	return nil, nil
 
+func (s *achievementService) OnUnlock(fn func(user *User, achievement Achievement)) {
+	s.onUnlock = fn
+}
+
+func (s *achievementService) Evaluate(user *User, metrics ...string) ([]Achievement, error) {
+	var owned []string
+	if err := s.db.Model(&UserAchievement{}).Where("user_id = ?", user.ID).Pluck("achievement_id", &owned).Error; err != nil {
+		return nil, err
+	}
+	has := make(map[string]bool, len(owned))
+	for _, id := range owned {
+		has[id] = true
+	}
+
+	// Find the candidates first so every metric is only fetched once
+	var candidates []*catalogAchievement
+	needed := make(map[string]bool)
+	catalog := s.catalog.Load()
+	for i := range catalog.achievements {
+		a := &catalog.achievements[i]
+		if has[a.ID] || !readsAny(a.criteria, metrics) {
+			continue
+		}
+		candidates = append(candidates, a)
+		for _, m := range a.criteria.Metrics() {
+			needed[m] = true
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(needed))
+	for name := range needed {
+		names = append(names, name)
+	}
+	values, err := s.metrics.Metrics(user, names)
+	if err != nil {
+		return nil, err
+	}
+
+	var unlocked []Achievement
+	for _, a := range candidates {
+		if !a.criteria.Eval(values) {
+			continue
+		}
+		added, err := s.RewardAchievement(user, a.ID)
+		if err != nil {
+			return unlocked, err
+		}
+		if added {
+			unlocked = append(unlocked, a.Achievement)
+		}
+	}
+	return unlocked, nil
+}
+
+// readsAny reports whether criteria read one of metrics, no metrics means
+// everything is checked
+func readsAny(criteria Criteria, metrics []string) bool {
+	if len(metrics) == 0 {
+		return true
+	}
+	for _, m := range metrics {
+		if criteria.uses(m) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *achievementService) GetAchievements(user *User) ([]UserAchievement, error) {
+	achievements := []UserAchievement{}
+	err := s.db.Preload("Achievement").
+		Where("user_id = ?", user.ID).
+		Order("unlocked_at").
+		Find(&achievements).Error
+	return achievements, err
+}
+
+var achievements AchievementService
+
+func setAnnounceAchievementsHandler(c echo.Context, db *gorm.DB) error {
+	enabled, err := strconv.ParseBool(c.FormValue("enabled"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "enabled must be true or false",
+		})
+	}
+
+	var user User
+	if err := db.Where("username = ?", GetUsername(c)).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	if err := db.Model(&user).Update("announce_achievements", enabled).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to update preference",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"announce_achievements": enabled,
+	})
+}
+
+func getUserAchievements(c echo.Context, db *gorm.DB) error {
+	var user User
+	if err := db.Where("username = ?", c.Param("username")).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	unlocked, err := achievements.GetAchievements(&user)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch achievements",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"username":     user.Username,
+		"achievements": unlocked,
+	})
 }
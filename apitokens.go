@@ -0,0 +1,313 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// API tokens look like "acp_<random>", the prefix lets Authorize tell them
+// apart from JWTs without trying to parse them
+const apiTokenPrefix = "acp_"
+
+const (
+	ScopeProfileRead   = "profile:read"
+	ScopeProfileWrite  = "profile:write"
+	ScopeRoomsRead     = "rooms:read"
+	ScopeRoomsWrite    = "rooms:write"
+	ScopeMessagesWrite = "messages:write"
+	ScopeAdmin         = "admin"
+)
+
+var knownScopes = map[string]bool{
+	ScopeProfileRead:   true,
+	ScopeProfileWrite:  true,
+	ScopeRoomsRead:     true,
+	ScopeRoomsWrite:    true,
+	ScopeMessagesWrite: true,
+	ScopeAdmin:         true,
+}
+
+const (
+	maxAPITokensPerUser = 20
+	// Don't write last_used_at on every request
+	apiTokenTouchInterval = time.Minute
+)
+
+// APIToken is a named, scoped token a user can hand to scripts and bots. Only
+// the hash of the token is stored
+type APIToken struct {
+	gorm.Model
+	UserID     uint       `gorm:"index" json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `gorm:"size:16" json:"prefix"`
+	TokenHash  string     `gorm:"size:64;uniqueIndex" json:"-"`
+	Scopes     string     `json:"-"` // space separated
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+func (t *APIToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+// parseScopes splits a comma or space separated scope list and rejects unknown
+// scopes
+func parseScopes(raw string) ([]string, bool) {
+	seen := make(map[string]bool)
+	var scopes []string
+	for _, scope := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !knownScopes[scope] {
+			return nil, false
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, len(scopes) > 0
+}
+
+// authorizeAPIToken resolves an API token to its user, it is called by
+// Authorize for tokens with the API token prefix
+func authorizeAPIToken(c echo.Context, db *gorm.DB, tokenString string) error {
+	var token APIToken
+	if err := db.Where("token_hash = ?", hashToken(tokenString)).First(&token).Error; err != nil {
+		return ErrAuth
+	}
+
+	now := time.Now()
+	if token.RevokedAt != nil || (token.ExpiresAt != nil && now.After(*token.ExpiresAt)) {
+		return ErrAuth
+	}
+
+	var user User
+	if err := db.First(&user, token.UserID).Error; err != nil {
+		return ErrAuth
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > apiTokenTouchInterval {
+		db.Model(&token).Update("last_used_at", now)
+	}
+
+	c.Set("username", user.Username)
+	c.Set("api_token_id", token.ID)
+	c.Set("scopes", token.ScopeList())
+	return nil
+}
+
+// HasScope reports whether the authenticated request may use scope. Session
+// JWTs carry every scope, API tokens only the ones they were minted with
+func HasScope(c echo.Context, scope string) bool {
+	scopes, ok := c.Get("scopes").([]string)
+	if !ok {
+		return true
+	}
+	return containsScope(scopes, scope)
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAPITokenRequest reports whether the request was authenticated with an
+// API token instead of a session
+func IsAPITokenRequest(c echo.Context) bool {
+	_, ok := c.Get("api_token_id").(uint)
+	return ok
+}
+
+// RejectAPITokens keeps API tokens away from routes that manage credentials,
+// sessions and tokens. Only a real sign in may change how the account signs in
+func RejectAPITokens() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if IsAPITokenRequest(c) {
+				return c.JSON(http.StatusForbidden, map[string]string{
+					"error": "API tokens can't manage credentials, sessions or tokens",
+				})
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireScope rejects requests authenticated with an API token that lacks
+// scope. Unauthenticated requests are passed through so handlers that allow
+// guests keep working
+func RequireScope(db *gorm.DB, scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if GetUsername(c) == "" {
+				if err := Authorize(c, db); err != nil {
+					return next(c)
+				}
+			}
+			if !HasScope(c, scope) {
+				return c.JSON(http.StatusForbidden, map[string]string{
+					"error": "Token is missing the " + scope + " scope",
+				})
+			}
+			return next(c)
+		}
+	}
+}
+
+func listAPITokensHandler(c echo.Context, db *gorm.DB) error {
+	username := GetUsername(c)
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	var tokens []APIToken
+	if err := db.Where("user_id = ?", user.ID).Order("created_at desc").Find(&tokens).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch tokens",
+		})
+	}
+
+	response := make([]map[string]interface{}, 0, len(tokens))
+	for _, t := range tokens {
+		response = append(response, map[string]interface{}{
+			"id":           t.ID,
+			"name":         t.Name,
+			"prefix":       t.Prefix,
+			"scopes":       t.ScopeList(),
+			"created_at":   t.CreatedAt,
+			"expires_at":   t.ExpiresAt,
+			"last_used_at": t.LastUsedAt,
+			"revoked_at":   t.RevokedAt,
+		})
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func createAPITokenHandler(c echo.Context, db *gorm.DB) error {
+	username := GetUsername(c)
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	if name == "" || len(name) > 64 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Token name is required and must be at most 64 characters",
+		})
+	}
+
+	scopes, ok := parseScopes(c.FormValue("scopes"))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "At least one valid scope is required",
+		})
+	}
+	if containsScope(scopes, ScopeAdmin) && !user.IsAdmin() {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "Only admins can mint tokens with the admin scope",
+		})
+	}
+
+	var expiresAt *time.Time
+	if days := c.FormValue("expires_in_days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 || n > 365 {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "expires_in_days must be between 1 and 365",
+			})
+		}
+		t := time.Now().AddDate(0, 0, n)
+		expiresAt = &t
+	}
+
+	var count int64
+	db.Model(&APIToken{}).Where("user_id = ? AND revoked_at IS NULL", user.ID).Count(&count)
+	if count >= maxAPITokensPerUser {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Too many active tokens, revoke one first",
+		})
+	}
+
+	secret, err := generateToken(32)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to generate token",
+		})
+	}
+	raw := apiTokenPrefix + secret
+
+	token := &APIToken{
+		UserID:    user.ID,
+		Name:      name,
+		Prefix:    raw[:len(apiTokenPrefix)+6],
+		TokenHash: hashToken(raw),
+		Scopes:    strings.Join(scopes, " "),
+		ExpiresAt: expiresAt,
+	}
+	if err := db.Create(token).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to create token",
+		})
+	}
+
+	// The raw token is only ever returned here
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"id":         token.ID,
+		"name":       token.Name,
+		"token":      raw,
+		"scopes":     scopes,
+		"expires_at": token.ExpiresAt,
+	})
+}
+
+// revokeUserAPITokens revokes every active API token of a user, used after a
+// password reset
+func revokeUserAPITokens(db *gorm.DB, userID uint) error {
+	return db.Model(&APIToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+func revokeAPITokenHandler(c echo.Context, db *gorm.DB) error {
+	username := GetUsername(c)
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	result := db.Model(&APIToken{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", c.Param("id"), user.ID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to revoke token",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Token not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Token revoked",
+	})
+}
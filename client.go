@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -48,8 +50,34 @@ type Client struct {
 	// A user pointer to allow multiple sockets for a single user
 	user *User
 
-	// The current room the client is in
+	// The current room the client is in and its role there, which decides
+	// what it may do. Only the hub changes them, under mu, so the hub reads
+	// them directly and other goroutines go through room
+	mu          sync.Mutex
 	currentRoom string
+	roomRole    string
+
+	// Scopes of the API token the client connected with, nil for sessions
+	scopes []string
+
+	// The login session the client belongs to, empty for guests and API tokens
+	sessionID string
+}
+
+// room returns the current room of the client and its role there
+func (c *Client) room() (roomID, role string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.currentRoom, c.roomRole
+}
+
+// setRoom is called by the hub when the client joins or leaves a room or its
+// role there changes
+func (c *Client) setRoom(roomID, role string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.currentRoom = roomID
+	c.roomRole = role
 }
 
 // readPump pumps messages from the ws connection to the hub
@@ -83,17 +111,36 @@ func (c *Client) readPump() {
 				Content: string(message),
 			}
 		}
+		// Only the content comes from the client, types like announcements
+		// and the metadata are set by the server
+		chatMsg = ChatMessage{Content: chatMsg.Content}
+
+		// API tokens without messages:write can only read
+		if c.scopes != nil && !containsScope(c.scopes, ScopeMessagesWrite) {
+			continue
+		}
 
 		// Set username if available
 		if c.user != nil {
 			chatMsg.Username = c.user.Username
 		}
 
-		// If no room specified in message but client is in a room, use that
-		if chatMsg.RoomID == "" && c.currentRoom != "" {
-			chatMsg.RoomID = c.currentRoom
+		// Clients can only talk in the room they joined, and only if their
+		// role there allows it
+		roomID, role := c.room()
+		if roomID == "" || !RoleHasPermission(role, PermRoomSend) {
+			continue
 		}
+		chatMsg.RoomID = roomID
 
+		if strings.HasPrefix(chatMsg.Content, "/") {
+			c.runCommand(roomID, chatMsg.Content)
+			continue
+		}
+
+		chatMsg.ID, _ = generateToken(12)
+		chatMsg.Coins = coinRegistry.parseCashtags(chatMsg.Content)
+		chatMsg.sender = c
 		c.hub.broadcast <- chatMsg
 	}
 }
@@ -157,18 +204,47 @@ func (c *Client) writePump() {
 	}
 }
 
-// joinRoom makes the client join a chat room
-func (c *Client) joinRoom(roomID string) {
+// joinRoom makes the client join a chat room if its role there allows reading
+func (c *Client) joinRoom(roomID string) bool {
+	var room ChatRoom
+	if err := c.hub.db.Where("room_id = ?", roomID).First(&room).Error; err != nil {
+		return false
+	}
+
+	// Outsiders of private and password rooms have no role there, so this
+	// also keeps them out
+	role := RoomRoleOf(c.hub.db, c.user, &room)
+	if !RoleHasPermission(role, PermRoomRead) {
+		return false
+	}
+
+	var mutedUntil time.Time
+	if c.user != nil {
+		if activeBan(c.hub.db, room.ID, c.user.ID) != nil {
+			return false
+		}
+		var participant RoomParticipant
+		if err := c.hub.db.Where("room_id = ? AND user_id = ?", room.ID, c.user.ID).First(&participant).Error; err == nil && participant.MutedUntil != nil {
+			mutedUntil = *participant.MutedUntil
+		}
+	}
+
 	// If client is already in a room, leave it first
-	if c.currentRoom != "" {
-		c.leaveRoom(c.currentRoom)
+	if current, _ := c.room(); current != "" {
+		c.leaveRoom(current)
 	}
 
 	// Join the new room
 	c.hub.joinRoom <- &ClientRoomAction{
 		Client: c,
 		RoomID: roomID,
+		Role:   role,
+
+		MutedUntil: mutedUntil,
+		SlowMode:   time.Duration(room.SlowModeSeconds) * time.Second,
+		Archived:   room.ArchivedAt != nil,
 	}
+	return true
 }
 
 // leaveRoom makes the client leave a chat room
@@ -193,7 +269,7 @@ func serveWs(hub *Hub, c echo.Context, db *gorm.DB) error {
 		hub:         hub,
 		conn:        conn,
 		send:        make(chan ChatMessage, 256),
-		currentRoom: roomID,
+		currentRoom: "",
 		user:        nil,
 	}
 
@@ -204,10 +280,21 @@ func serveWs(hub *Hub, c echo.Context, db *gorm.DB) error {
 		if err := db.Where("username = ?", username).First(&user).Error; err == nil {
 			client.user = &user
 		}
+		if scopes, ok := c.Get("scopes").([]string); ok {
+			client.scopes = scopes
+		}
+		client.sessionID = GetSessionID(c)
 	}
 
 	client.hub.register <- client
 
+	if client.user != nil {
+		deliverUnseenAchievements(db, hub, client)
+		deliverPendingPriceAlerts(db, hub, client)
+		// Achievements added to the catalog since are checked on connect
+		publishAchievementEvent(client.user.ID)
+	}
+
 	// Join room if specified
 	if roomID != "" {
 		client.joinRoom(roomID)
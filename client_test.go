@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+// Run with -race, the hub changes the room of a client while its read loop
+// looks at it
+func TestClientRoomWhileHubMovesIt(t *testing.T) {
+	h := newHub(nil)
+	go h.run()
+	client := &Client{hub: h, send: make(chan ChatMessage, 256), user: &User{Username: "alice"}}
+	client.user.ID = 1
+	h.register <- client
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			roomID := "a"
+			if i%2 == 1 {
+				roomID = "b"
+			}
+			h.joinRoom <- &ClientRoomAction{Client: client, RoomID: roomID, Role: RoomRoleMember}
+			h.roomEvents <- &RoomEvent{Kind: RoomEventRole, RoomID: roomID, UserID: 1, Role: RoomRoleModerator}
+			h.leaveRoom <- &ClientRoomAction{Client: client, RoomID: roomID}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			if roomID, role := client.room(); roomID != "" || role != "" {
+				t.Fatalf("room after leaving = %q, %q", roomID, role)
+			}
+			return
+		default:
+			roomID, role := client.room()
+			if (roomID == "") != (role == "") {
+				t.Fatalf("room %q with role %q", roomID, role)
+			}
+		}
+	}
+}
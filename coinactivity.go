@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxFavoriteCoins     = 50
+	defaultCoinWindow    = 7 * 24 * time.Hour
+	maxCoinWindow        = 365 * 24 * time.Hour
+	defaultCoinListLimit = 10
+	maxCoinListLimit     = 100
+)
+
+// FavoriteCoin is a coin a user favorited
+type FavoriteCoin struct {
+	UserID    uint      `gorm:"primaryKey" json:"-"`
+	Symbol    string    `gorm:"primaryKey;size:10" json:"symbol"`
+	CreatedAt time.Time `json:"favorited_at"`
+}
+
+// CoinCount is a coin with how often it was mentioned in a window
+type CoinCount struct {
+	Coin
+	Mentions int64 `json:"mentions"`
+	// Distinct users that mentioned the coin, only set on trending lists
+	Users int64 `json:"users,omitempty"`
+}
+
+// parseCoinWindow reads the window query param. It takes durations like
+// "24h" or "7d", "all" means no limit and returns 0
+func parseCoinWindow(s string) (time.Duration, error) {
+	switch s {
+	case "":
+		return defaultCoinWindow, nil
+	case "all":
+		return 0, nil
+	}
+	d, err := parseModerationDuration(s)
+	if err != nil || d == 0 || d > maxCoinWindow {
+		return 0, ErrInvalidInput
+	}
+	return d, nil
+}
+
+func describeCoinWindow(d time.Duration) string {
+	if d == 0 {
+		return "all"
+	}
+	if d%(24*time.Hour) == 0 {
+		return strconv.Itoa(int(d/(24*time.Hour))) + "d"
+	}
+	return d.String()
+}
+
+// coinQueryParams parses window and limit
+func coinQueryParams(c echo.Context) (time.Duration, int, error) {
+	window, err := parseCoinWindow(c.QueryParam("window"))
+	if err != nil {
+		return 0, 0, errors.New("window must be a duration like 24h or 7d up to 365d, or all")
+	}
+	limit := defaultCoinListLimit
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxCoinListLimit {
+			return 0, 0, errors.New("limit must be between 1 and 100")
+		}
+		limit = n
+	}
+	return window, limit, nil
+}
+
+// mentionsSince narrows a coin_mentions query to a window, 0 means all time
+func mentionsSince(q *gorm.DB, window time.Duration) *gorm.DB {
+	if window == 0 {
+		return q
+	}
+	return q.Where("created_at >= ?", time.Now().Add(-window))
+}
+
+// outsidePrivateRooms drops the mentions made in private rooms from a
+// coin_mentions query, they must not show up on lists anyone can read. Rooms
+// that were deleted still count, their mentions stay private
+func outsidePrivateRooms(db *gorm.DB, q *gorm.DB) *gorm.DB {
+	private := db.Unscoped().Model(&ChatRoom{}).Select("room_id").Where("visibility = ?", RoomVisibilityPrivate)
+	return q.Where("room_id NOT IN (?)", private)
+}
+
+// resolveCoinCounts fills in the registry metadata. Coins that were removed
+// from the registry keep their symbol as name
+func resolveCoinCounts(counts []CoinCount) []CoinCount {
+	for i := range counts {
+		if coin, ok := coinRegistry.Lookup(counts[i].Symbol); ok {
+			counts[i].Coin = coin
+		} else {
+			counts[i].Name = counts[i].Symbol
+		}
+	}
+	return counts
+}
+
+// topCoins ranks the coins of a coin_mentions query by mentions
+func topCoins(q *gorm.DB, withUsers bool, limit int) ([]CoinCount, error) {
+	sel := "symbol, COUNT(*) AS mentions"
+	if withUsers {
+		sel += ", COUNT(DISTINCT user_id) AS users"
+	}
+	counts := []CoinCount{}
+	err := q.Select(sel).
+		Group("symbol").
+		Order("mentions DESC, symbol").
+		Limit(limit).
+		Scan(&counts).Error
+	return resolveCoinCounts(counts), err
+}
+
+// favoriteCoinHandler favorites or unfavorites a coin for the current user
+func favoriteCoinHandler(c echo.Context, db *gorm.DB, favorite bool) error {
+	coin, ok := coinRegistry.Lookup(c.Param("symbol"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Unknown coin",
+		})
+	}
+
+	var user User
+	if err := db.Where("username = ?", GetUsername(c)).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	if !favorite {
+		if err := db.Where("user_id = ? AND symbol = ?", user.ID, coin.Symbol).Delete(&FavoriteCoin{}).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to update favorites",
+			})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"symbol":    coin.Symbol,
+			"favorited": false,
+		})
+	}
+
+	var count int64
+	db.Model(&FavoriteCoin{}).Where("user_id = ? AND symbol <> ?", user.ID, coin.Symbol).Count(&count)
+	if count >= maxFavoriteCoins {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "You can favorite up to " + strconv.Itoa(maxFavoriteCoins) + " coins",
+		})
+	}
+
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&FavoriteCoin{UserID: user.ID, Symbol: coin.Symbol}).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to update favorites",
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"symbol":    coin.Symbol,
+		"favorited": true,
+	})
+}
+
+// getUserCoins returns the favorited coins of a user, each with how often the
+// user mentioned it in the window outside private rooms
+func getUserCoins(c echo.Context, db *gorm.DB) error {
+	window, _, err := coinQueryParams(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	var user User
+	if err := db.Where("username = ?", c.Param("username")).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	var favorites []FavoriteCoin
+	if err := db.Where("user_id = ?", user.ID).Order("created_at").Find(&favorites).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch coins",
+		})
+	}
+
+	counts := map[string]int64{}
+	if len(favorites) > 0 {
+		symbols := make([]string, len(favorites))
+		for i, f := range favorites {
+			symbols[i] = f.Symbol
+		}
+		var rows []CoinCount
+		if err := outsidePrivateRooms(db, mentionsSince(db.Model(&CoinMention{}), window)).
+			Select("symbol, COUNT(*) AS mentions").
+			Where("user_id = ? AND symbol IN ?", user.ID, symbols).
+			Group("symbol").
+			Scan(&rows).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to fetch coins",
+			})
+		}
+		for _, row := range rows {
+			counts[row.Symbol] = row.Mentions
+		}
+	}
+
+	type favoriteResponse struct {
+		CoinCount
+		FavoritedAt time.Time `json:"favorited_at"`
+	}
+	coins := make([]favoriteResponse, 0, len(favorites))
+	for _, f := range favorites {
+		entry := favoriteResponse{CoinCount: CoinCount{Coin: Coin{Symbol: f.Symbol}, Mentions: counts[f.Symbol]}, FavoritedAt: f.CreatedAt}
+		entry.CoinCount = resolveCoinCounts([]CoinCount{entry.CoinCount})[0]
+		coins = append(coins, entry)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"username": user.Username,
+		"window":   describeCoinWindow(window),
+		"coins":    coins,
+	})
+}
+
+// userMostActiveCoins returns the coins the user sent the most messages about,
+// leaving out private rooms
+func userMostActiveCoins(c echo.Context, db *gorm.DB) error {
+	window, limit, err := coinQueryParams(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	var user User
+	if err := db.Where("username = ?", c.Param("username")).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	coins, err := topCoins(outsidePrivateRooms(db, mentionsSince(db.Model(&CoinMention{}), window)).Where("user_id = ?", user.ID), false, limit)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch coins",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"username": user.Username,
+		"window":   describeCoinWindow(window),
+		"coins":    coins,
+	})
+}
+
+// trendingCoinsHandler ranks the coins mentioned the most across all rooms
+// that aren't private
+func trendingCoinsHandler(c echo.Context, db *gorm.DB) error {
+	window, limit, err := coinQueryParams(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	coins, err := topCoins(outsidePrivateRooms(db, mentionsSince(db.Model(&CoinMention{}), window)), true, limit)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch trending coins",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"window": describeCoinWindow(window),
+		"coins":  coins,
+	})
+}
+
+// roomTrendingCoinsHandler ranks the coins mentioned the most in one room
+func roomTrendingCoinsHandler(c echo.Context, db *gorm.DB) error {
+	user, room := contextUserAndRoom(c)
+	if !CanViewRoom(db, user, room) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Room not found",
+		})
+	}
+
+	window, limit, err := coinQueryParams(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	coins, err := topCoins(mentionsSince(db.Model(&CoinMention{}), window).Where("room_id = ?", room.RoomID), true, limit)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch trending coins",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"room_id": room.RoomID,
+		"window":  describeCoinWindow(window),
+		"coins":   coins,
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestOutsidePrivateRooms(t *testing.T) {
+	db := newTestDB(t)
+	owner := createTestUser(t, db, "alice")
+	rooms := []*ChatRoom{
+		{Name: "lobby", RoomID: "lobby", OwnerID: owner.ID, Visibility: RoomVisibilityPublic},
+		{Name: "secret", RoomID: "secret", OwnerID: owner.ID, Visibility: RoomVisibilityPrivate},
+		{Name: "gone", RoomID: "gone", OwnerID: owner.ID, Visibility: RoomVisibilityPrivate},
+	}
+	for _, room := range rooms {
+		if err := db.Create(room).Error; err != nil {
+			t.Fatal(err)
+		}
+		mention := &CoinMention{MessageID: room.RoomID, UserID: owner.ID, RoomID: room.RoomID, Symbol: "BTC", CreatedAt: time.Now()}
+		if err := db.Create(mention).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(rooms[2]).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var visible []string
+	if err := outsidePrivateRooms(db, db.Model(&CoinMention{})).Pluck("room_id", &visible).Error; err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(visible)
+	if len(visible) != 1 || visible[0] != "lobby" {
+		t.Fatalf("mentions outside private rooms = %v, want [lobby]", visible)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// Room kinds, stored on ChatRoom.Kind
+const (
+	RoomKindStandard = "standard"
+	// Canonical room of a coin, created by the server
+	RoomKindCoin = "coin"
+)
+
+// How coin rooms get created, set with COIN_ROOMS
+const (
+	// On the first cashtag of the coin
+	CoinRoomsOnMention = "mention"
+	// For every registered coin at startup, and on mention
+	CoinRoomsRegistry = "registry"
+	CoinRoomsOff      = "off"
+)
+
+var coinRoomsMode = CoinRoomsOnMention
+
+// coinRoomID is the room ID of a coin room, e.g. "coin-btc"
+func coinRoomID(symbol string) string {
+	return "coin-" + strings.ToLower(symbol)
+}
+
+// coinRooms remembers which coin rooms exist so mentions don't hit the
+// database, and serializes creating them
+var coinRooms = struct {
+	sync.Mutex
+	known map[string]bool
+}{known: make(map[string]bool)}
+
+// ensureCoinRoom returns the room of a coin, creating it if needed. Coin
+// rooms have no participant limit and are public. They also have no owner
+// (OwnerID 0), so global admins, who act as owners of every room, are their
+// moderators and can promote participants to moderator with the room role
+// endpoint
+func ensureCoinRoom(db *gorm.DB, coin Coin) (*ChatRoom, error) {
+	coinRooms.Lock()
+	defer coinRooms.Unlock()
+
+	var room ChatRoom
+	err := db.Where("room_id = ?", coinRoomID(coin.Symbol)).First(&room).Error
+	if err == nil {
+		coinRooms.known[coin.Symbol] = true
+		return &room, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	room = ChatRoom{
+		Name:            "#" + strings.ToLower(coin.Symbol),
+		Description:     fmt.Sprintf("Everything about %s ($%s)", coin.Name, coin.Symbol),
+		MaxParticipants: 0,
+		RoomID:          coinRoomID(coin.Symbol),
+		Visibility:      RoomVisibilityPublic,
+		Kind:            RoomKindCoin,
+		CoinSymbol:      coin.Symbol,
+	}
+	if err := db.Create(&room).Error; err != nil {
+		return nil, err
+	}
+	if err := setRoomTags(db, room.ID, []string{"coin", strings.ToLower(coin.Symbol)}); err != nil {
+		return nil, err
+	}
+	coinRooms.known[coin.Symbol] = true
+	slog.Info("created coin room", "room", room.RoomID)
+	return &room, nil
+}
+
+// ensureMentionedCoinRooms creates the rooms of mentioned coins that don't
+// have one yet
+func ensureMentionedCoinRooms(db *gorm.DB, mentions []CoinMention) {
+	if coinRoomsMode == CoinRoomsOff {
+		return
+	}
+	for _, m := range mentions {
+		coinRooms.Lock()
+		known := coinRooms.known[m.Symbol]
+		coinRooms.Unlock()
+		if known {
+			continue
+		}
+		coin, ok := coinRegistry.Lookup(m.Symbol)
+		if !ok {
+			continue
+		}
+		if _, err := ensureCoinRoom(db, coin); err != nil {
+			slog.Error("failed to create coin room", "symbol", m.Symbol, "error", err)
+		}
+	}
+}
+
+// setupCoinRooms reads COIN_ROOMS and creates the rooms of all registered
+// coins when it is "registry"
+func setupCoinRooms(db *gorm.DB) error {
+	switch mode := os.Getenv("COIN_ROOMS"); mode {
+	case "":
+	case CoinRoomsOnMention, CoinRoomsRegistry, CoinRoomsOff:
+		coinRoomsMode = mode
+	default:
+		return fmt.Errorf("unknown COIN_ROOMS %q, use mention, registry or off", mode)
+	}
+
+	if coinRoomsMode != CoinRoomsRegistry {
+		return nil
+	}
+	for _, coin := range coinRegistry.Coins() {
+		if _, err := ensureCoinRoom(db, coin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// announcementMessage is a read-only post the server makes to a room, users
+// can't send this type
+func announcementMessage(roomID, content string) ChatMessage {
+	return ChatMessage{
+		Type:    MessageTypeAnnouncement,
+		Content: content,
+		RoomID:  roomID,
+	}
+}
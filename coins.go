@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// Cashtags past this many in one message are ignored
+	maxCashtagsPerMessage = 10
+	maxCoinMentionBatch   = 500
+)
+
+// Coin is an entry of the coin registry
+type Coin struct {
+	Symbol string `json:"symbol"`
+	Name   string `json:"name"`
+	// Identifier used by price providers, e.g. "bitcoin"
+	ID string `json:"id,omitempty"`
+}
+
+// CoinRegistry maps ticker symbols to coins. It is never modified after
+// loading
+type CoinRegistry struct {
+	coins    []Coin
+	bySymbol map[string]*Coin
+}
+
+var coinRegistry *CoinRegistry
+
+// loadCoinRegistry reads a JSON array of coins
+func loadCoinRegistry(path string) (*CoinRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var coins []Coin
+	if err := json.Unmarshal(data, &coins); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	registry := &CoinRegistry{
+		coins:    make([]Coin, 0, len(coins)),
+		bySymbol: make(map[string]*Coin, len(coins)),
+	}
+	for _, coin := range coins {
+		coin.Symbol = strings.ToUpper(strings.TrimSpace(coin.Symbol))
+		if !cashtagSymbol.MatchString(coin.Symbol) || coin.Name == "" {
+			return nil, fmt.Errorf("%s: coins need a name and a symbol of up to 10 letters or digits, got %q", path, coin.Symbol)
+		}
+		if _, dup := registry.bySymbol[coin.Symbol]; dup {
+			return nil, fmt.Errorf("%s: duplicate coin %q", path, coin.Symbol)
+		}
+		registry.coins = append(registry.coins, coin)
+		registry.bySymbol[coin.Symbol] = &registry.coins[len(registry.coins)-1]
+	}
+	return registry, nil
+}
+
+// Lookup finds a coin by symbol, case insensitive and with or without the $
+func (r *CoinRegistry) Lookup(symbol string) (Coin, bool) {
+	if r == nil {
+		return Coin{}, false
+	}
+	coin, ok := r.bySymbol[strings.ToUpper(strings.TrimPrefix(symbol, "$"))]
+	if !ok {
+		return Coin{}, false
+	}
+	return *coin, true
+}
+
+// Coins returns every registered coin in registry order
+func (r *CoinRegistry) Coins() []Coin {
+	if r == nil {
+		return nil
+	}
+	return append([]Coin(nil), r.coins...)
+}
+
+var (
+	cashtagSymbol = regexp.MustCompile(`^[A-Z][A-Z0-9]{0,9}$`)
+	// A $ followed by a letter, not preceded by a word character or another $
+	// so prices like "$100" and "US$" don't count
+	cashtagPattern = regexp.MustCompile(`(?:^|[^\w$])\$([A-Za-z][A-Za-z0-9]{0,9})\b`)
+)
+
+// parseCashtags returns the registered coins mentioned in content, in order
+// of first mention and without duplicates
+func (r *CoinRegistry) parseCashtags(content string) []Coin {
+	if r == nil || !strings.Contains(content, "$") {
+		return nil
+	}
+	var found []Coin
+	seen := map[string]bool{}
+	for _, m := range cashtagPattern.FindAllStringSubmatch(content, -1) {
+		coin, ok := r.Lookup(m[1])
+		if !ok || seen[coin.Symbol] {
+			continue
+		}
+		seen[coin.Symbol] = true
+		found = append(found, coin)
+		if len(found) == maxCashtagsPerMessage {
+			break
+		}
+	}
+	return found
+}
+
+// CoinMention records a coin mentioned in a chat message
+type CoinMention struct {
+	ID        uint      `gorm:"primaryKey" json:"-"`
+	MessageID string    `gorm:"size:32;index" json:"message_id"`
+	UserID    uint      `gorm:"index:idx_coin_mentions_user_symbol" json:"-"`
+	RoomID    string    `gorm:"size:32;index:idx_coin_mentions_room_symbol" json:"room_id"`
+	Symbol    string    `gorm:"size:10;index:idx_coin_mentions_user_symbol;index:idx_coin_mentions_room_symbol;index" json:"symbol"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// coinMentions is buffered so the hub never waits on the database
+var coinMentions = make(chan CoinMention, 1024)
+
+// recordCoinMentions queues the mentions of a message sent by a user. When
+// the queue is full the mentions are dropped
+func recordCoinMentions(message ChatMessage) {
+	if message.sender == nil || message.sender.user == nil {
+		return
+	}
+	now := time.Now()
+	for _, coin := range message.Coins {
+		select {
+		case coinMentions <- CoinMention{
+			MessageID: message.ID,
+			UserID:    message.sender.user.ID,
+			RoomID:    message.RoomID,
+			Symbol:    coin.Symbol,
+			CreatedAt: now,
+		}:
+		default:
+			return
+		}
+	}
+}
+
+// runCoinMentionWriter stores queued mentions, inserting whatever piled up
+// since the last write in one statement
+func runCoinMentionWriter(db *gorm.DB, mentions <-chan CoinMention) {
+	for mention := range mentions {
+		batch := []CoinMention{mention}
+
+	drain:
+		for len(batch) < maxCoinMentionBatch {
+			select {
+			case m := <-mentions:
+				batch = append(batch, m)
+			default:
+				break drain
+			}
+		}
+
+		if err := db.Create(&batch).Error; err != nil {
+			slog.Error("failed to store coin mentions", "count", len(batch), "error", err)
+		}
+		ensureMentionedCoinRooms(db, batch)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chatCommand handles a slash command typed into a room. args holds the words
+// after the command name
+type chatCommand struct {
+	usage      string
+	permission Permission
+	run        func(c *Client, room *ChatRoom, args []string) string
+}
+
+// chatCommands maps a command name, without the slash, to its handler
+var chatCommands = map[string]chatCommand{
+	"kick": {
+		usage:      "/kick <username> [reason]",
+		permission: PermRoomModerate,
+		run: func(c *Client, room *ChatRoom, args []string) string {
+			if len(args) < 1 {
+				return ""
+			}
+			target, err := kickUser(c.hub.db, c.hub, room, c.user, args[0], strings.Join(args[1:], " "))
+			if err != nil {
+				return commandError(err)
+			}
+			return "Kicked " + target.Username
+		},
+	},
+	"ban": {
+		usage:      "/ban <username> [duration] [reason]",
+		permission: PermRoomModerate,
+		run: func(c *Client, room *ChatRoom, args []string) string {
+			if len(args) < 1 {
+				return ""
+			}
+			duration, reason := durationAndReason(args[1:])
+			target, err := banUser(c.hub.db, c.hub, room, c.user, args[0], duration, reason)
+			if err != nil {
+				return commandError(err)
+			}
+			return "Banned " + target.Username + " " + describeDuration(duration)
+		},
+	},
+	"unban": {
+		usage:      "/unban <username>",
+		permission: PermRoomModerate,
+		run: func(c *Client, room *ChatRoom, args []string) string {
+			if len(args) != 1 {
+				return ""
+			}
+			target, err := unbanUser(c.hub.db, room, c.user, args[0])
+			if err != nil {
+				return commandError(err)
+			}
+			return "Unbanned " + target.Username
+		},
+	},
+	"mute": {
+		usage:      "/mute <username> [duration] [reason]",
+		permission: PermRoomModerate,
+		run: func(c *Client, room *ChatRoom, args []string) string {
+			if len(args) < 1 {
+				return ""
+			}
+			duration, reason := durationAndReason(args[1:])
+			target, err := muteUser(c.hub.db, c.hub, room, c.user, args[0], duration, reason)
+			if err != nil {
+				return commandError(err)
+			}
+			return "Muted " + target.Username + " " + describeDuration(duration)
+		},
+	},
+	"unmute": {
+		usage:      "/unmute <username>",
+		permission: PermRoomModerate,
+		run: func(c *Client, room *ChatRoom, args []string) string {
+			if len(args) != 1 {
+				return ""
+			}
+			target, err := unmuteUser(c.hub.db, c.hub, room, c.user, args[0])
+			if err != nil {
+				return commandError(err)
+			}
+			return "Unmuted " + target.Username
+		},
+	},
+	"topic": {
+		usage:      "/topic <text>, /topic - clears it",
+		permission: PermRoomModerate,
+		run: func(c *Client, room *ChatRoom, args []string) string {
+			if len(args) == 0 {
+				return ""
+			}
+			topic := strings.Join(args, " ")
+			if topic == "-" {
+				topic = ""
+			}
+			if err := setRoomTopic(c.hub.db, c.hub, room, c.user, topic); err != nil {
+				if errors.Is(err, ErrRoomArchived) {
+					return "Archived rooms can't be changed, unarchive it first"
+				}
+				if errors.Is(err, ErrInvalidInput) {
+					return "Topic must be at most 200 characters"
+				}
+				return "Failed to update topic"
+			}
+			return "Topic updated"
+		},
+	},
+	"slow": {
+		usage:      "/slow <seconds>, 0 turns it off",
+		permission: PermRoomModerate,
+		run: func(c *Client, room *ChatRoom, args []string) string {
+			if len(args) != 1 {
+				return ""
+			}
+			seconds, err := strconv.Atoi(args[0])
+			if err != nil {
+				return ""
+			}
+			if err := setSlowMode(c.hub.db, c.hub, room, c.user, seconds); err != nil {
+				return commandError(err)
+			}
+			return "Slow mode updated"
+		},
+	},
+	"price": {
+		usage:      "/price <symbol>",
+		permission: PermRoomRead,
+		run: func(c *Client, room *ChatRoom, args []string) string {
+			if len(args) != 1 {
+				return ""
+			}
+			coin, ok := coinRegistry.Lookup(args[0])
+			if !ok {
+				return "Unknown coin " + args[0]
+			}
+			if prices == nil {
+				return "Prices are not available"
+			}
+			price, ok := prices.Get(coin.Symbol)
+			if !ok {
+				return "No price for $" + coin.Symbol + " yet"
+			}
+			return formatPrice(price)
+		},
+	},
+	"alert": {
+		usage:      "/alert <symbol> above|below|crosses <price> [recurring], /alert list or /alert remove <id>",
+		permission: PermRoomRead,
+		run: func(c *Client, room *ChatRoom, args []string) string {
+			db := c.hub.db
+			switch {
+			case len(args) == 1 && args[0] == "list":
+				alerts, err := listPriceAlerts(db, c.user)
+				if err != nil {
+					return "Failed to fetch alerts"
+				}
+				if len(alerts) == 0 {
+					return "You have no active alerts"
+				}
+				lines := make([]string, len(alerts))
+				for i, alert := range alerts {
+					lines[i] = "#" + strconv.FormatUint(uint64(alert.ID), 10) + " " + alert.describe()
+				}
+				return strings.Join(lines, "\n")
+
+			case len(args) == 2 && args[0] == "remove":
+				id, err := strconv.ParseUint(strings.TrimPrefix(args[1], "#"), 10, 64)
+				if err != nil {
+					return ""
+				}
+				deleted, err := deletePriceAlert(db, c.user, uint(id))
+				if err != nil {
+					return "Failed to delete alert"
+				}
+				if !deleted {
+					return "Alert not found"
+				}
+				return "Alert deleted"
+
+			case len(args) == 3 || len(args) == 4:
+				direction := map[string]string{">": AlertAbove, "<": AlertBelow}[args[1]]
+				if direction == "" {
+					direction = strings.ToLower(args[1])
+				}
+				target, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimPrefix(args[2], "$"), ",", ""), 64)
+				if err != nil {
+					return ""
+				}
+				mode := AlertModeOnce
+				if len(args) == 4 {
+					mode = strings.ToLower(args[3])
+				}
+				alert, err := createPriceAlert(db, c.user, args[0], direction, target, mode)
+				switch {
+				case errors.Is(err, ErrInvalidInput):
+					msg := strings.TrimPrefix(err.Error(), ErrInvalidInput.Error()+": ")
+					return strings.ToUpper(msg[:1]) + msg[1:]
+				case errors.Is(err, ErrAlertLimit):
+					return "You can have up to " + strconv.Itoa(maxPriceAlerts) + " active alerts"
+				case err != nil:
+					return "Failed to create alert"
+				}
+				return "Alert #" + strconv.FormatUint(uint64(alert.ID), 10) + " set: " + alert.describe()
+			}
+			return ""
+		},
+	},
+}
+
+// durationAndReason treats the first argument as a duration if it parses as
+// one, everything else is the reason
+func durationAndReason(args []string) (time.Duration, string) {
+	if len(args) > 0 {
+		if d, err := parseModerationDuration(args[0]); err == nil {
+			return d, strings.Join(args[1:], " ")
+		}
+	}
+	return 0, strings.Join(args, " ")
+}
+
+// commandError shows the moderation errors to the user and hides the rest
+func commandError(err error) string {
+	switch {
+	case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrCannotModerate),
+		errors.Is(err, ErrNotBanned), errors.Is(err, ErrNotParticipant), errors.Is(err, ErrInvalidInput):
+		msg := err.Error()
+		return strings.ToUpper(msg[:1]) + msg[1:]
+	}
+	return "Moderation action failed"
+}
+
+// runCommand executes a slash command sent by the client in roomID, its
+// current room. The result is only shown to the client
+func (c *Client) runCommand(roomID, content string) {
+	fields := strings.Fields(strings.TrimPrefix(content, "/"))
+	if len(fields) == 0 {
+		return
+	}
+
+	reply := func(text string) {
+		c.hub.notify <- &Notification{Client: c, Message: systemMessage(roomID, text)}
+	}
+
+	cmd, ok := chatCommands[strings.ToLower(fields[0])]
+	if !ok {
+		reply("Unknown command /" + fields[0])
+		return
+	}
+
+	var room ChatRoom
+	if err := c.hub.db.Where("room_id = ?", roomID).First(&room).Error; err != nil {
+		reply("Room not found")
+		return
+	}
+	if c.user == nil || !CanInRoom(c.hub.db, c.user, &room, cmd.permission) {
+		reply("You don't have permission to do that in this room")
+		return
+	}
+
+	result := cmd.run(c, &room, fields[1:])
+	if result == "" {
+		result = "Usage: " + cmd.usage
+	}
+	reply(result)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestDB opens an in-memory database of its own for the test with every
+// model migrated
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	db, err := gorm.Open(sqlite.Open("file:"+name+"?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One connection keeps the database alive and serializes the goroutines
+	// that handlers start
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(&User{}, &ChatRoom{}, &RoomParticipant{}, &UserToken{}, &RecoveryCode{}, &PasskeyCredential{}, &APIToken{}, &AuditLog{}, &Session{}, &RoomBan{}, &ModerationLog{}, &RoomInvite{}, &RoomTag{}, &Achievement{}, &UserAchievement{}, &UserStats{}, &UserDailyActivity{}, &UserRoomActivity{}, &CoinMention{}, &FavoriteCoin{}, &PriceAlert{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// createTestUser stores a user with the given username
+func createTestUser(t *testing.T, db *gorm.DB, username string) *User {
+	t.Helper()
+	user := &User{Username: username, Email: username + "@example.com"}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// setupTestAchievements loads the achievement catalog into db and makes it the
+// service the handlers use
+func setupTestAchievements(t *testing.T, db *gorm.DB) AchievementService {
+	t.Helper()
+	service, err := NewAchievementService(db, "achievements.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := achievements
+	achievements = service
+	t.Cleanup(func() { achievements = saved })
+	return service
+}
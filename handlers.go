@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -23,16 +24,91 @@ func loginHandler(c echo.Context, db *gorm.DB) error {
 	email := c.FormValue("email")
 	password := c.FormValue("password")
 
+	if ok, err := checkLoginAllowed(c, db, email); !ok {
+		return err
+	}
+
+	// Unknown emails and wrong passwords get the same answer so the response
+	// can't be used to find out which emails have an account
+	invalid := map[string]string{
+		"error": "Invalid email or password",
+	}
+
 	var user User
 	if err := db.Where("email = ?", email).First(&user).Error; err != nil {
-		return errors.New("email not found")
+		burnPasswordCheck(password)
+		recordLoginFailure(c, db, email, nil)
+		return c.JSON(http.StatusUnauthorized, invalid)
+	}
+
+	ok, needsRehash, err := verifyPassword(password, user.HashedPassword)
+	if err != nil {
+		// A full hash pool says nothing about the password, so it doesn't
+		// count as a failure
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": "The server is busy, please try again",
+		})
+	}
+	if !ok {
+		recordLoginFailure(c, db, email, &user)
+		return c.JSON(http.StatusUnauthorized, invalid)
+	}
+
+	// Upgrade the stored hash to the current hasher settings now that we know
+	// the plain password
+	if needsRehash {
+		go rehashPassword(db, user.ID, password, user.HashedPassword)
+	}
+
+	if !verifiedOrAllowed(&user, unverifiedPolicy.CanLogin) {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "You must verify your email before logging in",
+		})
 	}
 
-	if !checkPasswordHash(password, user.HashedPassword) {
-		return errors.New("invalid password")
+	// Failures only count against the password step once 2FA is done
+	if !user.TOTPEnabled {
+		recordLoginSuccess(email)
 	}
 
-	token, err := GenerateJWT(user.Username)
+	if user.TOTPEnabled {
+		mfaToken, err := GenerateMFAToken(user.Username)
+		if err != nil {
+			return errors.New("failed to generate token")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+		})
+	}
+
+	return issueLoginToken(c, db, &user)
+}
+
+// rehashPassword replaces oldHash with a hash made with the current settings.
+// If the password changed in the meantime the stored hash is left alone
+func rehashPassword(db *gorm.DB, userID uint, password, oldHash string) {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		log.Printf("failed to rehash password for user %d: %v", userID, err)
+		return
+	}
+	if err := db.Model(&User{}).
+		Where("id = ? AND hashed_password = ?", userID, oldHash).
+		Update("hashed_password", hashedPassword).Error; err != nil {
+		log.Printf("failed to store rehashed password for user %d: %v", userID, err)
+	}
+}
+
+// issueLoginToken generates the JWT for a user who finished logging in, sets
+// the token cookie and writes the login response
+func issueLoginToken(c echo.Context, db *gorm.DB, user *User) error {
+	session, err := createSession(c, db, user)
+	if err != nil {
+		return errors.New("failed to create session")
+	}
+
+	token, err := GenerateJWT(user.Username, session.SessionID)
 	if err != nil {
 		return errors.New("failed to generate token")
 	}
@@ -40,7 +116,7 @@ func loginHandler(c echo.Context, db *gorm.DB) error {
 	cookie := new(http.Cookie)
 	cookie.Name = "token"
 	cookie.Value = token
-	cookie.Expires = time.Now().Add(24 * time.Hour)
+	cookie.Expires = session.ExpiresAt
 	cookie.HttpOnly = true
 	cookie.Path = "/"
 	// for prod
@@ -48,17 +124,61 @@ func loginHandler(c echo.Context, db *gorm.DB) error {
 	// cookie.SameSite = http.SameSiteStrictMode
 	c.SetCookie(cookie)
 
-	return c.JSON(http.StatusOK, map[string]string{
-		"token":    token,
-		"username": user.Username,
+	// Catch up on achievements added to the catalog since the last login.
+	// These unlocks already went to the hub, which shows them or leaves them
+	// unseen for the next connection, so they are left out below
+	pushed := make(map[string]bool)
+	unlocked, err := achievements.Evaluate(user)
+	if err != nil {
+		log.Printf("failed to evaluate achievements for user %d: %v", user.ID, err)
+	}
+	for _, a := range unlocked {
+		pushed[a.ID] = true
+	}
+
+	// Unlocks the user missed while offline are shown once at login
+	missed, err := unseenAchievements(db, user.ID)
+	if err != nil {
+		missed = []UserAchievement{}
+	}
+	unseen := make([]UserAchievement, 0, len(missed))
+	seen := make([]string, 0, len(missed))
+	for _, ua := range missed {
+		if pushed[ua.AchievementID] {
+			continue
+		}
+		unseen = append(unseen, ua)
+		seen = append(seen, ua.AchievementID)
+	}
+	markAchievementsSeen(db, user.ID, seen...)
+
+	// So are price alerts that fired in the meantime
+	alerts, err := pendingPriceAlerts(db, user.ID)
+	if err != nil {
+		alerts = []PriceAlert{}
+	}
+	markPriceAlertsDelivered(db, alerts...)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"token":        token,
+		"username":     user.Username,
+		"achievements": unseen,
+		"price_alerts": alerts,
 	})
 }
 
-func logoutHandler(c echo.Context, db *gorm.DB) error {
+func logoutHandler(c echo.Context, db *gorm.DB, hub *Hub) error {
 	if err := Authorize(c, db); err != nil {
 		return err
 	}
 
+	var session Session
+	if err := db.Where("session_id = ?", GetSessionID(c)).First(&session).Error; err == nil {
+		if err := revokeSession(db, hub, &session); err != nil {
+			log.Printf("failed to revoke session on logout: %v", err)
+		}
+	}
+
 	// Clear the token cookie
 	cookie := new(http.Cookie)
 	cookie.Name = "token"
@@ -106,9 +226,14 @@ func registerHandler(c echo.Context, db *gorm.DB) error {
 	email := c.FormValue("email")
 	password := c.FormValue("password")
 
-	if len(username) < 3 || email == "" || len(password) < 8 {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Invalid information",
+	var fieldErrors []FieldError
+	fieldErrors = append(fieldErrors, validateUsername(username)...)
+	fieldErrors = append(fieldErrors, validateEmail(email)...)
+	fieldErrors = append(fieldErrors, passwordPolicy.Validate(password, username, email)...)
+	if len(fieldErrors) > 0 {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":  "Invalid information",
+			"fields": fieldErrors,
 		})
 	}
 
@@ -116,15 +241,17 @@ func registerHandler(c echo.Context, db *gorm.DB) error {
 
 	exists := db.Where("email = ?", email).First(&user)
 	if exists.Error == nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Email already exists",
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":  "Email already exists",
+			"fields": []FieldError{{Field: "email", Code: "taken", Message: "Email already exists"}},
 		})
 	}
 
 	exists = db.Where("username = ?", username).First(&user)
 	if exists.Error == nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Username already exists",
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":  "Username already exists",
+			"fields": []FieldError{{Field: "username", Code: "taken", Message: "Username already exists"}},
 		})
 	}
 
@@ -147,19 +274,16 @@ func registerHandler(c echo.Context, db *gorm.DB) error {
 		})
 	}
 
+	if err := sendVerificationEmail(db, newUser); err != nil {
+		log.Printf("failed to send verification email to %s: %v", username, err)
+	}
+
 	fmt.Println("User created:", username)
 	return c.JSON(http.StatusCreated, map[string]string{
-		"message": "User created successfully",
+		"message": "User created successfully, check your email to verify your account",
 	})
 }
 
-func incrementMessagesSent(c echo.Context) error {
-	// check where the user sent the message and then increment by 1
-	// for total messages, and by 1 for the coin they sent the message about
-	// also check the # of messages to see if they got an achievement
-	return nil
-}
-
 func deleteUser(c echo.Context) error {
 	return nil
 }
@@ -168,21 +292,6 @@ func getUserHandler(c echo.Context) error {
 	return nil
 }
 
-func getUserCoins(c echo.Context, db *gorm.DB) error {
-	// returns the users "favorited" coins TO THE MOON! HODL!
-	return nil
-}
-
-func userMostActiveCoins(e echo.Context, db *gorm.DB) error {
-	// returns coins the user has sent the most messages about
-	return nil
-}
-
-func getUserAchievements(c echo.Context, db *gorm.DB) error {
-	// returns the users achievements
-	return nil
-}
-
 // these are the handlers for oauth
 func oAuthCallbackHandler(c echo.Context) error {
 	req := c.Request()
@@ -289,6 +398,12 @@ func createRoomHandler(c echo.Context, db *gorm.DB) error {
 		})
 	}
 
+	if !verifiedOrAllowed(&user, unverifiedPolicy.CanCreateRoom) {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "You must verify your email to create a room",
+		})
+	}
+
 	roomName := c.FormValue("name")
 	if roomName == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{
@@ -309,12 +424,35 @@ func createRoomHandler(c echo.Context, db *gorm.DB) error {
 		}
 	}
 
+	description := strings.TrimSpace(c.FormValue("description"))
+	if !validRoomDescription(description) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Description must be at most 500 characters",
+		})
+	}
+
+	tags, err := normalizeTags(c.FormValue("tags"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid tags, " + err.Error(),
+		})
+	}
+
+	visibility := c.FormValue("visibility")
+	if visibility == "" {
+		visibility = RoomVisibilityPublic
+	}
+	if !validRoomVisibility(visibility) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Visibility must be public, unlisted or private",
+		})
+	}
+
 	password := c.FormValue("password")
 	hasPassword := password != ""
 
 	hashedPassword := ""
 	if hasPassword {
-		var err error
 		hashedPassword, err = hashPassword(password)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -327,11 +465,13 @@ func createRoomHandler(c echo.Context, db *gorm.DB) error {
 
 	room := &ChatRoom{
 		Name:            roomName,
+		Description:     description,
 		OwnerID:         user.ID,
 		Password:        hashedPassword,
 		HasPassword:     hasPassword,
 		MaxParticipants: maxParticipants,
 		RoomID:          roomID,
+		Visibility:      visibility,
 	}
 
 	if err := db.Create(room).Error; err != nil {
@@ -340,12 +480,19 @@ func createRoomHandler(c echo.Context, db *gorm.DB) error {
 		})
 	}
 
+	if err := setRoomTags(db, room.ID, tags); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save room tags",
+		})
+	}
+
 	participant := &RoomParticipant{
 		RoomID:     room.ID,
 		UserID:     user.ID,
 		JoinedAt:   time.Now(),
 		IsActive:   true,
 		LastActive: time.Now(),
+		Role:       RoomRoleOwner,
 	}
 
 	if err := db.Create(participant).Error; err != nil {
@@ -354,27 +501,19 @@ func createRoomHandler(c echo.Context, db *gorm.DB) error {
 		})
 	}
 
+	incrementRoomsJoined(&user)
+	publishAchievementEvent(user.ID, MetricRoomsCreated, MetricRoomsJoined)
+
 	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"message":  "Room created successfully",
-		"room_id":  roomID,
-		"name":     roomName,
-		"password": hasPassword,
+		"message":    "Room created successfully",
+		"room_id":    roomID,
+		"name":       roomName,
+		"password":   hasPassword,
+		"visibility": visibility,
+		"tags":       tags,
 	})
 }
 
-func listRoomsHandler(c echo.Context, db *gorm.DB) error {
-	var rooms []ChatRoom
-
-	if err := db.Select("id, name, has_password, max_participants, room_id, owner_id, created_at").
-		Find(&rooms).Error; err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to fetch rooms",
-		})
-	}
-
-	return c.JSON(http.StatusOK, rooms)
-}
-
 func joinRoomHandler(c echo.Context, db *gorm.DB) error {
 	roomID := c.Param("roomID")
 	if roomID == "" {
@@ -390,6 +529,13 @@ func joinRoomHandler(c echo.Context, db *gorm.DB) error {
 		})
 	}
 
+	// Private rooms look like they don't exist to outsiders
+	if !CanViewRoom(db, optionalUser(c, db), &room) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Room not found",
+		})
+	}
+
 	if room.HasPassword {
 		password := c.FormValue("password")
 		if !checkPasswordHash(password, room.Password) {
@@ -422,9 +568,27 @@ func joinRoomHandler(c echo.Context, db *gorm.DB) error {
 		})
 	}
 
+	if !verifiedOrAllowed(&user, unverifiedPolicy.CanJoinRoom) {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "You must verify your email to join this room",
+		})
+	}
+
+	if room.ArchivedAt != nil {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "This room is archived",
+		})
+	}
+
+	if activeBan(db, room.ID, user.ID) != nil {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "You are banned from this room",
+		})
+	}
+
 	var participantCount int64
 	db.Model(&RoomParticipant{}).Where("room_id = ? AND is_active = ?", room.ID, true).Count(&participantCount)
-	if int(participantCount) >= room.MaxParticipants {
+	if room.MaxParticipants > 0 && int(participantCount) >= room.MaxParticipants {
 		return c.JSON(http.StatusForbidden, map[string]string{
 			"error": "Room is full",
 		})
@@ -441,12 +605,14 @@ func joinRoomHandler(c echo.Context, db *gorm.DB) error {
 			JoinedAt:   time.Now(),
 			IsActive:   true,
 			LastActive: time.Now(),
+			Role:       RoomRoleMember,
 		}
 		if err := db.Create(&participant).Error; err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]string{
 				"error": "Failed to join room",
 			})
 		}
+		incrementRoomsJoined(&user)
 	} else {
 
 		db.Model(&participant).Updates(map[string]interface{}{
@@ -455,6 +621,8 @@ func joinRoomHandler(c echo.Context, db *gorm.DB) error {
 		})
 	}
 
+	publishAchievementEvent(user.ID, MetricRoomsJoined)
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"room_id":   room.RoomID,
 		"name":      room.Name,
@@ -522,14 +690,28 @@ func getRoomInfoHandler(c echo.Context, db *gorm.DB) error {
 		})
 	}
 
+	// Private rooms look like they don't exist to outsiders
+	if !CanViewRoom(db, optionalUser(c, db), &room) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Room not found",
+		})
+	}
+
 	var participantCount int64
 	db.Model(&RoomParticipant{}).Where("room_id = ? AND is_active = ?", room.ID, true).Count(&participantCount)
 
 	room.Password = ""
 
+	// null for rooms without a limit
+	var availableSlots interface{}
+	if room.MaxParticipants > 0 {
+		availableSlots = room.MaxParticipants - int(participantCount)
+	}
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"room":            room,
+		"tags":            roomTagNames(db, room.ID)[room.ID],
 		"active_users":    participantCount,
-		"available_slots": room.MaxParticipants - int(participantCount),
+		"available_slots": availableSlots,
 	})
 }
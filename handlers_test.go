@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestIssueLoginTokenDeliversUnlocksOnce(t *testing.T) {
+	db := newTestDB(t)
+	service := setupTestAchievements(t, db)
+	var pushed []string
+	service.OnUnlock(func(user *User, achievement Achievement) {
+		pushed = append(pushed, achievement.ID)
+	})
+
+	user := &User{Username: "alice", Email: "alice@example.com", EmailVerified: true}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Unlocked while the user was offline
+	if err := db.Create(&UserAchievement{UserID: user.ID, AchievementID: "room_creator", UnlockedAt: time.Now()}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/login", nil), rec)
+	if err := issueLoginToken(c, db, user); err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Achievements []UserAchievement `json:"achievements"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verifying the email unlocks "verified" during login, the hub has it
+	if len(pushed) != 1 || pushed[0] != "verified" {
+		t.Fatalf("pushed unlocks = %v, want [verified]", pushed)
+	}
+	if len(body.Achievements) != 1 || body.Achievements[0].AchievementID != "room_creator" {
+		t.Fatalf("login response achievements = %+v, want only room_creator", body.Achievements)
+	}
+
+	var verified, creator UserAchievement
+	db.Where("user_id = ? AND achievement_id = ?", user.ID, "verified").First(&verified)
+	db.Where("user_id = ? AND achievement_id = ?", user.ID, "room_creator").First(&creator)
+	if verified.SeenAt != nil {
+		t.Fatal("login marked the pushed unlock seen")
+	}
+	if creator.SeenAt == nil {
+		t.Fatal("login didn't mark the returned unlock seen")
+	}
+}
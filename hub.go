@@ -1,21 +1,69 @@
 package main
 
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Message types, user messages leave Type empty
+const (
+	MessageTypeSystem      = "system"
+	MessageTypeAchievement = "achievement"
+	MessageTypePrice       = "price"
+	MessageTypePriceAlert  = "price_alert"
+	// Read-only posts made by the server, e.g. price updates in coin rooms
+	MessageTypeAnnouncement = "announcement"
+)
+
+// Rooms get price updates for coins mentioned there within this window
+const priceEventWindow = 30 * time.Minute
+
 // ChatMessage represents a message sent to the chat
 type ChatMessage struct {
+	// Set on messages sent by users
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
 	Content  string `json:"content"`
 	Username string `json:"username,omitempty"`
 	RoomID   string `json:"room_id"`
+
+	// Set on achievement unlock messages
+	Achievement *Achievement `json:"achievement,omitempty"`
+
+	// Coins mentioned with cashtags like $BTC
+	Coins []Coin `json:"coins,omitempty"`
+
+	// Set on price updates
+	Price *CoinPrice `json:"price,omitempty"`
+
+	// The client the message came from, nil for messages made by the server
+	sender *Client
+}
+
+func systemMessage(roomID, content string) ChatMessage {
+	return ChatMessage{
+		Type:    MessageTypeSystem,
+		Content: content,
+		RoomID:  roomID,
+	}
 }
 
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients
 type Hub struct {
+	db *gorm.DB
+
 	// registered clients
 	clients map[*Client]bool
 
 	// Map of roomID to clients in that room
 	rooms map[string]map[*Client]bool
 
+	// Moderation state of the rooms that have clients
+	roomStates map[string]*roomState
+
 	// Inbound messages from the clients
 	broadcast chan ChatMessage
 
@@ -30,22 +78,104 @@ type Hub struct {
 
 	// requests to leave a room
 	leaveRoom chan *ClientRoomAction
+
+	// revoked sessions whose clients must be disconnected
+	disconnectSession chan string
+
+	// changes to rooms and their members made outside the hub
+	roomEvents chan *RoomEvent
+
+	// messages for a single client or user
+	notify chan *Notification
+
+	// changed coin prices from the price service
+	prices chan []CoinPrice
+
+	// When each room last mentioned a coin, by symbol and room ID
+	recentCoins map[string]map[string]time.Time
 }
 
 type ClientRoomAction struct {
 	Client *Client
 	RoomID string
+	Role   string
+
+	// Moderation state loaded when joining
+	MutedUntil time.Time
+	SlowMode   time.Duration
+	Archived   bool
+}
+
+// Kinds of RoomEvent
+const (
+	RoomEventRole     = "role"
+	RoomEventKick     = "kick"
+	RoomEventMute     = "mute"
+	RoomEventUnmute   = "unmute"
+	RoomEventSlowMode = "slow_mode"
+	RoomEventUpdated  = "updated"
+	RoomEventArchived = "archived"
+	RoomEventDeleted  = "deleted"
+)
+
+// RoomEvent tells the hub about a change to a room or one of its members.
+// Message, if set, is broadcast to the room as a system message
+type RoomEvent struct {
+	Kind     string
+	RoomID   string
+	UserID   uint
+	Role     string
+	Until    time.Time
+	SlowMode time.Duration
+	Archived bool
+	Message  string
 }
 
-func newHub() *Hub {
+// Notification is a message for one client, or for every client of a user
+// when Client is nil
+type Notification struct {
+	Client  *Client
+	UserID  uint
+	Message ChatMessage
+
+	// Announce, if set, is posted as a system message to every room the
+	// user's clients are in
+	Announce string
+
+	// Delivered, if set, is called from the hub with the number of clients
+	// that got the message. It must not block
+	Delivered func(clients int)
+}
+
+type senderKey struct {
+	userID uint
+	client *Client // set for guests only
+}
+
+type roomState struct {
+	archived   bool
+	slowMode   time.Duration
+	mutedUntil map[uint]time.Time
+	lastSent   map[senderKey]time.Time
+}
+
+func newHub(db *gorm.DB) *Hub {
 	return &Hub{
+		db:         db,
 		broadcast:  make(chan ChatMessage),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
 		rooms:      make(map[string]map[*Client]bool),
+		roomStates: make(map[string]*roomState),
 		joinRoom:   make(chan *ClientRoomAction),
 		leaveRoom:  make(chan *ClientRoomAction),
+
+		disconnectSession: make(chan string),
+		roomEvents:        make(chan *RoomEvent),
+		notify:            make(chan *Notification),
+		prices:            make(chan []CoinPrice),
+		recentCoins:       make(map[string]map[string]time.Time),
 	}
 }
 
@@ -56,54 +186,284 @@ func (h *Hub) run() {
 			h.clients[client] = true
 
 		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
+			h.removeClient(client)
 
-				// Remove client from all rooms
-				for roomID, clients := range h.rooms {
-					if _, inRoom := clients[client]; inRoom {
-						delete(h.rooms[roomID], client)
-					}
+		case sessionID := <-h.disconnectSession:
+			for client := range h.clients {
+				if client.sessionID == sessionID {
+					h.removeClient(client)
 				}
-
-				close(client.send)
 			}
 
 		case action := <-h.joinRoom:
 			// Create room if it doesn't exist
 			if _, ok := h.rooms[action.RoomID]; !ok {
 				h.rooms[action.RoomID] = make(map[*Client]bool)
+				h.roomStates[action.RoomID] = &roomState{
+					archived:   action.Archived,
+					slowMode:   action.SlowMode,
+					mutedUntil: make(map[uint]time.Time),
+					lastSent:   make(map[senderKey]time.Time),
+				}
 			}
 			// Add client to room
 			h.rooms[action.RoomID][action.Client] = true
 
+			if action.Client.user != nil && !action.MutedUntil.IsZero() {
+				h.roomStates[action.RoomID].mutedUntil[action.Client.user.ID] = action.MutedUntil
+			}
+
 			// Set client's current room
-			action.Client.currentRoom = action.RoomID
+			action.Client.setRoom(action.RoomID, action.Role)
 
 		case action := <-h.leaveRoom:
 			// Remove client from room
-			if room, ok := h.rooms[action.RoomID]; ok {
-				delete(room, action.Client)
-			}
+			h.removeFromRoom(action.Client, action.RoomID)
 
-			if action.Client.currentRoom == action.RoomID {
-				action.Client.currentRoom = ""
-			}
+		case event := <-h.roomEvents:
+			h.handleRoomEvent(event)
+
+		case n := <-h.notify:
+			h.handleNotification(n)
+
+		case changed := <-h.prices:
+			h.handlePrices(changed)
 
 		case message := <-h.broadcast:
+			if !h.allowMessage(message) {
+				continue
+			}
+			if message.sender != nil {
+				incrementMessagesSent(message.sender.user, message.RoomID)
+				recordCoinMentions(message)
+			}
+			if message.RoomID != "" {
+				for _, coin := range message.Coins {
+					if h.recentCoins[coin.Symbol] == nil {
+						h.recentCoins[coin.Symbol] = make(map[string]time.Time)
+					}
+					h.recentCoins[coin.Symbol][message.RoomID] = time.Now()
+				}
+			}
+
 			// If room specified, only send to clients in that room
 			if message.RoomID != "" {
 				if roomClients, ok := h.rooms[message.RoomID]; ok {
 					for client := range roomClients {
-						client.send <- message
+						h.send(client, message)
 					}
 				}
 			} else {
 				// uhh this isnt needed anymore but change later
 				for client := range h.clients {
-					client.send <- message
+					h.send(client, message)
+				}
+			}
+		}
+	}
+}
+
+// handlePrices pushes changed prices to the rooms that recently talked about
+// the coins and forgets rooms that went quiet
+func (h *Hub) handlePrices(changed []CoinPrice) {
+	now := time.Now()
+	for _, price := range changed {
+		// The coin's own room always gets its price, as an announcement
+		coinRoom := coinRoomID(price.Symbol)
+		if clients, ok := h.rooms[coinRoom]; ok {
+			message := announcementMessage(coinRoom, formatPrice(price))
+			message.Price = &price
+			for client := range clients {
+				h.send(client, message)
+			}
+		}
+
+		rooms := h.recentCoins[price.Symbol]
+		for roomID, at := range rooms {
+			if now.Sub(at) > priceEventWindow {
+				delete(rooms, roomID)
+				continue
+			}
+			if roomID == coinRoom {
+				continue
+			}
+			for client := range h.rooms[roomID] {
+				h.send(client, priceMessage(roomID, price))
+			}
+		}
+		if len(rooms) == 0 {
+			delete(h.recentCoins, price.Symbol)
+		}
+	}
+}
+
+func (h *Hub) handleRoomEvent(event *RoomEvent) {
+	state := h.roomStates[event.RoomID]
+
+	switch event.Kind {
+	case RoomEventRole:
+		for client := range h.rooms[event.RoomID] {
+			if client.user != nil && client.user.ID == event.UserID {
+				client.setRoom(client.currentRoom, event.Role)
+			}
+		}
+
+	case RoomEventKick:
+		for client := range h.rooms[event.RoomID] {
+			if client.user != nil && client.user.ID == event.UserID {
+				h.send(client, systemMessage(event.RoomID, "You were removed from this room"))
+				h.removeFromRoom(client, event.RoomID)
+			}
+		}
+
+	case RoomEventMute:
+		if state != nil {
+			state.mutedUntil[event.UserID] = event.Until
+		}
+
+	case RoomEventUnmute:
+		if state != nil {
+			delete(state.mutedUntil, event.UserID)
+		}
+
+	case RoomEventSlowMode:
+		if state != nil {
+			state.slowMode = event.SlowMode
+		}
+
+	case RoomEventArchived:
+		if state != nil {
+			state.archived = event.Archived
+		}
+
+	case RoomEventDeleted:
+		for client := range h.rooms[event.RoomID] {
+			h.send(client, systemMessage(event.RoomID, event.Message))
+			h.removeClient(client)
+		}
+		return
+	}
+
+	if event.Message != "" {
+		for client := range h.rooms[event.RoomID] {
+			h.send(client, systemMessage(event.RoomID, event.Message))
+		}
+	}
+}
+
+func (h *Hub) handleNotification(n *Notification) {
+	delivered := 0
+	rooms := make(map[string]bool)
+	if n.Client != nil {
+		if _, ok := h.clients[n.Client]; ok {
+			h.send(n.Client, n.Message)
+			delivered++
+		}
+	} else {
+		for client := range h.clients {
+			if client.user != nil && client.user.ID == n.UserID {
+				if client.currentRoom != "" {
+					rooms[client.currentRoom] = true
 				}
+				h.send(client, n.Message)
+				delivered++
 			}
 		}
 	}
+
+	if n.Announce != "" {
+		for roomID := range rooms {
+			for client := range h.rooms[roomID] {
+				h.send(client, systemMessage(roomID, n.Announce))
+			}
+		}
+	}
+
+	if n.Delivered != nil {
+		n.Delivered(delivered)
+	}
+}
+
+// allowMessage applies mutes and slow mode to a message from a client and
+// tells the sender when their message was dropped
+func (h *Hub) allowMessage(message ChatMessage) bool {
+	sender := message.sender
+	if sender == nil {
+		return true
+	}
+	state, ok := h.roomStates[message.RoomID]
+	if !ok {
+		return true
+	}
+
+	if state.archived {
+		h.send(sender, systemMessage(message.RoomID, "This room is archived and read-only"))
+		return false
+	}
+
+	now := time.Now()
+	key := senderKey{client: sender}
+	if sender.user != nil {
+		key = senderKey{userID: sender.user.ID}
+		if until, muted := state.mutedUntil[sender.user.ID]; muted {
+			if now.Before(until) {
+				h.send(sender, systemMessage(message.RoomID, "You are muted in this room"))
+				return false
+			}
+			delete(state.mutedUntil, sender.user.ID)
+		}
+	}
+
+	// Moderators aren't slowed down
+	if state.slowMode > 0 && !RoleHasPermission(sender.roomRole, PermRoomModerate) {
+		if last, ok := state.lastSent[key]; ok && now.Sub(last) < state.slowMode {
+			wait := state.slowMode - now.Sub(last)
+			h.send(sender, systemMessage(message.RoomID, fmt.Sprintf("Slow mode is on, wait %ds before sending another message", int(wait.Seconds())+1)))
+			return false
+		}
+		state.lastSent[key] = now
+	}
+	return true
+}
+
+// send queues a message for a client. A client whose buffer is full is too
+// slow to keep up and gets disconnected instead of blocking the hub
+func (h *Hub) send(client *Client, message ChatMessage) {
+	select {
+	case client.send <- message:
+	default:
+		h.removeClient(client)
+	}
+}
+
+func (h *Hub) removeFromRoom(client *Client, roomID string) {
+	if room, ok := h.rooms[roomID]; ok {
+		delete(room, client)
+		if len(room) == 0 {
+			delete(h.rooms, roomID)
+			delete(h.roomStates, roomID)
+		}
+	}
+
+	if client.currentRoom == roomID {
+		client.setRoom("", "")
+	}
+}
+
+// removeClient drops the client from the hub and its rooms and closes its send
+// channel, which makes writePump close the connection
+func (h *Hub) removeClient(client *Client) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	delete(h.clients, client)
+
+	// Remove client from all rooms
+	for roomID, clients := range h.rooms {
+		if _, inRoom := clients[client]; inRoom {
+			h.removeFromRoom(client, roomID)
+		}
+	}
+
+	close(client.send)
 }
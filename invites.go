@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultInviteTTL = 24 * time.Hour
+	maxInviteTTL     = 30 * 24 * time.Hour
+	maxInviteUses    = 1000
+)
+
+// RoomInvite lets whoever holds its code join a room without the password.
+// The code is the nonce plus an HMAC of it, so made up codes are rejected
+// without a database lookup
+type RoomInvite struct {
+	gorm.Model
+	RoomID    uint       `gorm:"index" json:"-"`
+	CreatedBy uint       `json:"-"`
+	Nonce     string     `gorm:"size:32;uniqueIndex" json:"-"`
+	Role      string     `gorm:"size:16" json:"role"`
+	MaxUses   int        `json:"max_uses"` // 0 means unlimited
+	Uses      int        `json:"uses"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+func (i *RoomInvite) Active(now time.Time) bool {
+	return i.RevokedAt == nil && now.Before(i.ExpiresAt) && (i.MaxUses == 0 || i.Uses < i.MaxUses)
+}
+
+func (i *RoomInvite) Code() string {
+	return i.Nonce + "." + signInviteNonce(i.Nonce)
+}
+
+func signInviteNonce(nonce string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("invite:" + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// findInvite checks the signature of code and loads its invite and room
+func findInvite(db *gorm.DB, code string) (*RoomInvite, *ChatRoom, bool) {
+	nonce, signature, ok := strings.Cut(code, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signInviteNonce(nonce))) {
+		return nil, nil, false
+	}
+
+	var invite RoomInvite
+	if err := db.Where("nonce = ?", nonce).First(&invite).Error; err != nil {
+		return nil, nil, false
+	}
+	var room ChatRoom
+	if err := db.First(&room, invite.RoomID).Error; err != nil {
+		return nil, nil, false
+	}
+	return &invite, &room, true
+}
+
+func inviteResponse(invite *RoomInvite, room *ChatRoom) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         invite.ID,
+		"code":       invite.Code(),
+		"url":        appBaseURL + "/invite/" + invite.Code(),
+		"room_id":    room.RoomID,
+		"role":       invite.Role,
+		"uses":       invite.Uses,
+		"max_uses":   invite.MaxUses,
+		"expires_at": invite.ExpiresAt,
+		"revoked_at": invite.RevokedAt,
+		"created_at": invite.CreatedAt,
+		"active":     invite.Active(time.Now()),
+	}
+}
+
+func createInviteHandler(c echo.Context, db *gorm.DB) error {
+	actor, room := contextUserAndRoom(c)
+
+	if room.ArchivedAt != nil {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": "Archived rooms can't be joined",
+		})
+	}
+
+	ttl := defaultInviteTTL
+	if hours := c.FormValue("expires_in_hours"); hours != "" {
+		n, err := strconv.Atoi(hours)
+		if err != nil || n < 1 || time.Duration(n)*time.Hour > maxInviteTTL {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "expires_in_hours must be between 1 and 720",
+			})
+		}
+		ttl = time.Duration(n) * time.Hour
+	}
+
+	maxUses := 0
+	if uses := c.FormValue("max_uses"); uses != "" {
+		n, err := strconv.Atoi(uses)
+		if err != nil || n < 0 || n > maxInviteUses {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "max_uses must be between 0 and 1000",
+			})
+		}
+		maxUses = n
+	}
+
+	role := c.FormValue("role")
+	if role == "" {
+		role = RoomRoleMember
+	}
+	if role != RoomRoleModerator && role != RoomRoleMember && role != RoomRoleGuest {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Role must be moderator, member or guest",
+		})
+	}
+
+	nonce, err := generateToken(12)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to create invite",
+		})
+	}
+
+	invite := &RoomInvite{
+		RoomID:    room.ID,
+		CreatedBy: actor.ID,
+		Nonce:     nonce,
+		Role:      role,
+		MaxUses:   maxUses,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := db.Create(invite).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to create invite",
+		})
+	}
+
+	return c.JSON(http.StatusCreated, inviteResponse(invite, room))
+}
+
+func listInvitesHandler(c echo.Context, db *gorm.DB) error {
+	_, room := contextUserAndRoom(c)
+
+	var invites []RoomInvite
+	if err := db.Where("room_id = ?", room.ID).Order("created_at desc").Find(&invites).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch invites",
+		})
+	}
+
+	response := make([]map[string]interface{}, 0, len(invites))
+	for i := range invites {
+		response = append(response, inviteResponse(&invites[i], room))
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func revokeInviteHandler(c echo.Context, db *gorm.DB) error {
+	_, room := contextUserAndRoom(c)
+
+	result := db.Model(&RoomInvite{}).
+		Where("id = ? AND room_id = ? AND revoked_at IS NULL", c.Param("id"), room.ID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to revoke invite",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Invite not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Invite revoked",
+	})
+}
+
+// acceptInviteHandler makes the logged in user a participant of the invite's
+// room with the invite's role, skipping the room password
+func acceptInviteHandler(c echo.Context, db *gorm.DB) error {
+	invite, room, ok := findInvite(db, c.Param("code"))
+	if !ok || !invite.Active(time.Now()) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Invite is invalid or has expired",
+		})
+	}
+
+	if err := Authorize(c, db); err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "You must be logged in to use an invite",
+		})
+	}
+
+	var user User
+	if err := db.Where("username = ?", GetUsername(c)).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	if !verifiedOrAllowed(&user, unverifiedPolicy.CanJoinRoom) {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "You must verify your email to join this room",
+		})
+	}
+	if room.ArchivedAt != nil {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "This room is archived",
+		})
+	}
+	if activeBan(db, room.ID, user.ID) != nil {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "You are banned from this room",
+		})
+	}
+
+	// Members following an invite again don't use it up
+	var participant RoomParticipant
+	if err := db.Where("room_id = ? AND user_id = ?", room.ID, user.ID).First(&participant).Error; err == nil {
+		db.Model(&participant).Updates(map[string]interface{}{
+			"is_active":   true,
+			"last_active": time.Now(),
+		})
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"room_id":   room.RoomID,
+			"name":      room.Name,
+			"joined_at": participant.JoinedAt,
+		})
+	}
+
+	var participantCount int64
+	db.Model(&RoomParticipant{}).Where("room_id = ? AND is_active = ?", room.ID, true).Count(&participantCount)
+	if room.MaxParticipants > 0 && int(participantCount) >= room.MaxParticipants {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "Room is full",
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// The conditions make concurrent uses of the last slot race safely
+		result := tx.Model(&RoomInvite{}).
+			Where("id = ? AND revoked_at IS NULL AND expires_at > ? AND (max_uses = 0 OR uses < max_uses)", invite.ID, time.Now()).
+			Update("uses", gorm.Expr("uses + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		participant = RoomParticipant{
+			RoomID:     room.ID,
+			UserID:     user.ID,
+			JoinedAt:   time.Now(),
+			IsActive:   true,
+			LastActive: time.Now(),
+			Role:       invite.Role,
+		}
+		return tx.Create(&participant).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Invite is invalid or has expired",
+		})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to join room",
+		})
+	}
+
+	incrementRoomsJoined(&user)
+	publishAchievementEvent(user.ID, MetricRoomsJoined)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"room_id":   room.RoomID,
+		"name":      room.Name,
+		"role":      participant.Role,
+		"joined_at": participant.JoinedAt,
+	})
+}
+
+// inviteLandingHandler renders the room page in invite mode, the page accepts
+// the invite instead of asking for the room password
+func inviteLandingHandler(c echo.Context, db *gorm.DB) error {
+	code := c.Param("code")
+	invite, room, ok := findInvite(db, code)
+	if !ok || !invite.Active(time.Now()) {
+		return c.String(http.StatusNotFound, "This invite is invalid or has expired")
+	}
+
+	return c.Render(http.StatusOK, "chat_room.html", map[string]interface{}{
+		"RoomID":     room.RoomID,
+		"InviteCode": code,
+	})
+}
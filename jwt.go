@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -15,17 +16,29 @@ var (
 	jwtSecret = []byte("jwt-secret-key")
 )
 
+const (
+	// TokenPurposeMFAPending marks a token that only proves the password was
+	// correct, it can't be used for anything but the second login step
+	TokenPurposeMFAPending = "mfa_pending"
+
+	mfaPendingTTL = 5 * time.Minute
+)
+
 type Claims struct {
 	Username string `json:"username"`
+	Purpose  string `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func GenerateJWT(username string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+// GenerateJWT issues the session token of a login, sessionID is stored in the
+// jti claim so the token dies with its session
+func GenerateJWT(username, sessionID string) (string, error) {
+	expirationTime := time.Now().Add(sessionTTL)
 
 	claims := &Claims{
 		Username: username,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sessionID,
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Subject:   username,
@@ -42,6 +55,34 @@ func GenerateJWT(username string) (string, error) {
 	return tokenString, nil
 }
 
+// GenerateMFAToken issues the short lived token handed out after the password
+// check for users that have 2FA enabled
+func GenerateMFAToken(username string) (string, error) {
+	claims := &Claims{
+		Username: username,
+		Purpose:  TokenPurposeMFAPending,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaPendingTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Subject:   username,
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret)
+}
+
+func ValidateMFAToken(tokenString string) (*Claims, error) {
+	claims, err := ValidateJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != TokenPurposeMFAPending {
+		return nil, errors.New("not an mfa token")
+	}
+	return claims, nil
+}
+
 func ValidateJWT(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
@@ -62,12 +103,18 @@ func ValidateJWT(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
+// ExtractJWTFromRequest returns the bearer token of the request, which is
+// either a session JWT or an API token
 func ExtractJWTFromRequest(c echo.Context) string {
 	authHeader := c.Request().Header.Get("Authorization")
 	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
 		return authHeader[7:]
 	}
 
+	if apiKey := c.Request().Header.Get("X-API-Key"); apiKey != "" {
+		return apiKey
+	}
+
 	cookie, err := c.Cookie("token")
 	if err == nil {
 		return cookie.Value
@@ -82,17 +129,32 @@ func Authorize(c echo.Context, db *gorm.DB) error {
 		return ErrAuth
 	}
 
+	if strings.HasPrefix(tokenString, apiTokenPrefix) {
+		return authorizeAPIToken(c, db, tokenString)
+	}
+
 	claims, err := ValidateJWT(tokenString)
 	if err != nil {
 		return ErrAuth
 	}
 
+	// Purpose tokens such as the mfa pending one are not session tokens
+	if claims.Purpose != "" {
+		return ErrAuth
+	}
+
 	var user User
 	if err := db.Where("username = ?", claims.Username).First(&user).Error; err != nil {
 		return ErrAuth
 	}
 
+	session, err := loadActiveSession(db, claims.ID, user.ID)
+	if err != nil {
+		return ErrAuth
+	}
+
 	c.Set("username", claims.Username)
+	c.Set("session_id", session.SessionID)
 
 	return nil
 }
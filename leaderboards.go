@@ -0,0 +1,365 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Leaderboard metrics
+const (
+	LeaderboardMessages     = "messages"
+	LeaderboardStreaks      = "streaks"
+	LeaderboardAchievements = "achievements"
+)
+
+// Leaderboard periods. Daily and weekly run in UTC, weeks start on Monday
+const (
+	PeriodDaily   = "daily"
+	PeriodWeekly  = "weekly"
+	PeriodAllTime = "all_time"
+)
+
+const (
+	defaultLeaderboardLimit = 20
+	maxLeaderboardLimit     = 100
+	leaderboardCacheTTL     = time.Minute
+	maxLeaderboardCacheSize = 1000
+)
+
+type LeaderboardEntry struct {
+	Rank     int    `json:"rank"`
+	UserID   uint   `json:"-"`
+	Username string `json:"username"`
+	Value    int64  `json:"value"`
+}
+
+type Leaderboard struct {
+	Metric  string             `json:"metric"`
+	Period  string             `json:"period"`
+	RoomID  string             `json:"room_id,omitempty"`
+	Page    int                `json:"page"`
+	Limit   int                `json:"limit"`
+	Total   int64              `json:"total"`
+	Entries []LeaderboardEntry `json:"entries"`
+}
+
+// periodStart returns the first day of period, empty for all time
+func periodStart(period string, now time.Time) string {
+	now = now.UTC()
+	switch period {
+	case PeriodDaily:
+		return now.Format(statsDayLayout)
+	case PeriodWeekly:
+		offset := (int(now.Weekday()) + 6) % 7 // days since Monday
+		return now.AddDate(0, 0, -offset).Format(statsDayLayout)
+	}
+	return ""
+}
+
+// leaderboardScores builds a query returning one (user_id, value) row per
+// ranked user. room may be nil for the global board
+func leaderboardScores(db *gorm.DB, metric, period string, room *ChatRoom, now time.Time) (*gorm.DB, error) {
+	start := periodStart(period, now)
+
+	switch metric {
+	case LeaderboardMessages:
+		if room != nil {
+			q := db.Table("user_room_activities").
+				Select("user_id, SUM(messages) AS value").
+				Where("room_id = ?", room.RoomID)
+			if start != "" {
+				q = q.Where("day >= ?", start)
+			}
+			return q.Group("user_id"), nil
+		}
+		if start == "" {
+			return db.Table("user_stats").
+				Select("user_id, messages_sent AS value").
+				Where("messages_sent > 0"), nil
+		}
+		return db.Table("user_daily_activities").
+			Select("user_id, SUM(messages) AS value").
+			Where("day >= ?", start).
+			Group("user_id"), nil
+
+	case LeaderboardStreaks:
+		// All time ranks the longest streak ever, daily the streaks kept
+		// going today and weekly the longest run of active days this week
+		var q *gorm.DB
+		switch period {
+		case PeriodAllTime:
+			q = db.Table("user_stats").
+				Select("user_id, longest_streak AS value").
+				Where("longest_streak > 0")
+		case PeriodDaily:
+			q = db.Table("user_stats").
+				Select("user_id, current_streak AS value").
+				Where("current_streak > 0 AND last_active_day = ?", start)
+		default:
+			// Consecutive days minus their row number give the same date, so
+			// each run of days is one group
+			days := db.Table("user_daily_activities").
+				Select("user_id, DATE_SUB(day, INTERVAL ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY day) DAY) AS run").
+				Where("day >= ? AND messages > 0", start)
+			runs := db.Table("(?) AS d", days).
+				Select("user_id, COUNT(*) AS length").
+				Group("user_id, run")
+			q = db.Table("(?) AS r", runs).
+				Select("user_id, MAX(length) AS value").
+				Group("user_id")
+		}
+		if room != nil {
+			q = q.Where("user_id IN (?)", db.Table("room_participants").Select("user_id").Where("room_id = ?", room.ID))
+		}
+		return q, nil
+
+	case LeaderboardAchievements:
+		q := db.Table("user_achievements").Select("user_id, COUNT(*) AS value")
+		if start != "" {
+			day, _ := time.Parse(statsDayLayout, start)
+			q = q.Where("unlocked_at >= ?", day)
+		}
+		if room != nil {
+			q = q.Where("user_id IN (?)", db.Table("room_participants").Select("user_id").Where("room_id = ?", room.ID))
+		}
+		return q.Group("user_id"), nil
+	}
+	return nil, fmt.Errorf("unknown leaderboard metric %q", metric)
+}
+
+// queryLeaderboard returns one page of a leaderboard. Ties are broken by
+// user ID so every user has a distinct rank
+func queryLeaderboard(db *gorm.DB, metric, period string, room *ChatRoom, page, limit int) (*Leaderboard, error) {
+	scores, err := leaderboardScores(db, metric, period, room, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	board := &Leaderboard{Metric: metric, Period: period, Page: page, Limit: limit, Entries: []LeaderboardEntry{}}
+	if room != nil {
+		board.RoomID = room.RoomID
+	}
+
+	if err := db.Table("(?) AS s", scores).Count(&board.Total).Error; err != nil {
+		return nil, err
+	}
+
+	offset := (page - 1) * limit
+	if err := db.Table("(?) AS s", scores).
+		Select("s.user_id, users.username, s.value").
+		Joins("JOIN users ON users.id = s.user_id").
+		Order("s.value DESC, s.user_id ASC").
+		Limit(limit).
+		Offset(offset).
+		Scan(&board.Entries).Error; err != nil {
+		return nil, err
+	}
+	for i := range board.Entries {
+		board.Entries[i].Rank = offset + i + 1
+	}
+	return board, nil
+}
+
+// leaderboardRank returns the rank and value of a user, rank 0 means the user
+// isn't on the board
+func leaderboardRank(db *gorm.DB, metric, period string, room *ChatRoom, userID uint) (int64, int64, error) {
+	scores, err := leaderboardScores(db, metric, period, room, time.Now())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var values []int64
+	if err := db.Table("(?) AS s", scores).Where("s.user_id = ?", userID).Pluck("s.value", &values).Error; err != nil {
+		return 0, 0, err
+	}
+	if len(values) == 0 {
+		return 0, 0, nil
+	}
+	value := values[0]
+
+	var ahead int64
+	if err := db.Table("(?) AS s", scores).
+		Where("s.value > ? OR (s.value = ? AND s.user_id < ?)", value, value, userID).
+		Count(&ahead).Error; err != nil {
+		return 0, 0, err
+	}
+	return ahead + 1, value, nil
+}
+
+// leaderboardCache keeps recently served pages and the ranks of the users
+// that asked for them. Entries are tagged with the version at the time they
+// were computed, bumping the version drops them all
+type leaderboardCache struct {
+	version atomic.Uint64
+
+	mu      sync.Mutex
+	entries map[string]cachedLeaderboard
+	ranks   map[string]cachedRank
+}
+
+type cachedLeaderboard struct {
+	version uint64
+	expires time.Time
+	board   *Leaderboard
+}
+
+type cachedRank struct {
+	version uint64
+	expires time.Time
+	rank    int64
+	value   int64
+}
+
+var leaderboards = &leaderboardCache{
+	entries: make(map[string]cachedLeaderboard),
+	ranks:   make(map[string]cachedRank),
+}
+
+// invalidateLeaderboards is called whenever the data behind the boards
+// changes, stats flushes and achievement unlocks
+func invalidateLeaderboards() {
+	leaderboards.version.Add(1)
+}
+
+func (lc *leaderboardCache) get(key string) (*Leaderboard, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	entry, ok := lc.entries[key]
+	if !ok || entry.version != lc.version.Load() || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.board, true
+}
+
+func (lc *leaderboardCache) put(key string, version uint64, board *Leaderboard) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if len(lc.entries) >= maxLeaderboardCacheSize {
+		// Everything in here is cheap to compute again
+		lc.entries = make(map[string]cachedLeaderboard)
+	}
+	lc.entries[key] = cachedLeaderboard{version: version, expires: time.Now().Add(leaderboardCacheTTL), board: board}
+}
+
+func (lc *leaderboardCache) getRank(key string) (int64, int64, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	entry, ok := lc.ranks[key]
+	if !ok || entry.version != lc.version.Load() || time.Now().After(entry.expires) {
+		return 0, 0, false
+	}
+	return entry.rank, entry.value, true
+}
+
+func (lc *leaderboardCache) putRank(key string, version uint64, rank, value int64) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if len(lc.ranks) >= maxLeaderboardCacheSize {
+		lc.ranks = make(map[string]cachedRank)
+	}
+	lc.ranks[key] = cachedRank{version: version, expires: time.Now().Add(leaderboardCacheTTL), rank: rank, value: value}
+}
+
+// leaderboardHandler serves GET /api/leaderboards/:metric. Query params:
+// period (daily, weekly or all_time), room (a room ID for a room board),
+// page and limit. The response includes the rank of the current user
+func leaderboardHandler(c echo.Context, db *gorm.DB) error {
+	metric := c.Param("metric")
+	if metric != LeaderboardMessages && metric != LeaderboardStreaks && metric != LeaderboardAchievements {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Unknown leaderboard, use messages, streaks or achievements",
+		})
+	}
+
+	period := c.QueryParam("period")
+	if period == "" {
+		period = PeriodAllTime
+	}
+	if period != PeriodDaily && period != PeriodWeekly && period != PeriodAllTime {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "period must be daily, weekly or all_time",
+		})
+	}
+
+	page, limit := 1, defaultLeaderboardLimit
+	if p := c.QueryParam("page"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "page must be a positive number",
+			})
+		}
+		page = n
+	}
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxLeaderboardLimit {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "limit must be between 1 and 100",
+			})
+		}
+		limit = n
+	}
+
+	var user User
+	if err := db.Where("username = ?", GetUsername(c)).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	var room *ChatRoom
+	if roomID := c.QueryParam("room"); roomID != "" {
+		var r ChatRoom
+		if err := db.Where("room_id = ?", roomID).First(&r).Error; err != nil || !CanViewRoom(db, &user, &r) {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Room not found",
+			})
+		}
+		room = &r
+	}
+
+	key := fmt.Sprintf("%s|%s|%s|%d|%d", metric, period, c.QueryParam("room"), page, limit)
+	board, ok := leaderboards.get(key)
+	if !ok {
+		version := leaderboards.version.Load()
+		var err error
+		board, err = queryLeaderboard(db, metric, period, room, page, limit)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to fetch leaderboard",
+			})
+		}
+		leaderboards.put(key, version, board)
+	}
+
+	rankKey := fmt.Sprintf("%s|%s|%s|user:%d", metric, period, c.QueryParam("room"), user.ID)
+	rank, value, ok := leaderboards.getRank(rankKey)
+	if !ok {
+		version := leaderboards.version.Load()
+		var err error
+		rank, value, err = leaderboardRank(db, metric, period, room, user.ID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to fetch leaderboard",
+			})
+		}
+		leaderboards.putRank(rankKey, version, rank, value)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"leaderboard": board,
+		"me": map[string]interface{}{
+			"username": user.Username,
+			"rank":     rank,
+			"value":    value,
+		},
+	})
+}
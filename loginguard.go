@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	AuditAccountLocked   = "account_locked"
+	AuditAccountUnlocked = "account_unlocked"
+	AuditIPLocked        = "ip_locked"
+	AuditTOTPReset       = "totp_reset"
+)
+
+// AuditLog records security relevant events
+type AuditLog struct {
+	gorm.Model
+	Event    string `gorm:"size:64;index"`
+	UserID   uint   `gorm:"index"`
+	Username string
+	IP       string `gorm:"size:64"`
+	Details  string
+}
+
+func recordAudit(db *gorm.DB, event string, user *User, ip, details string) {
+	entry := &AuditLog{
+		Event:   event,
+		IP:      ip,
+		Details: details,
+	}
+	if user != nil {
+		entry.UserID = user.ID
+		entry.Username = user.Username
+	}
+	if err := db.Create(entry).Error; err != nil {
+		log.Printf("failed to write audit log %s: %v", event, err)
+	}
+}
+
+// LoginGuardConfig holds the thresholds of the login guard. Failures up to
+// FreeAttempts are not delayed, after that every failure doubles the delay
+// until LockoutAfter failures lock the key for LockoutDuration
+type LoginGuardConfig struct {
+	FreeAttempts    int
+	LockoutAfter    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutDuration time.Duration
+	// How long a key is remembered after its last failure
+	ResetAfter time.Duration
+}
+
+var (
+	accountGuardConfig = LoginGuardConfig{
+		FreeAttempts:    3,
+		LockoutAfter:    10,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutDuration: 15 * time.Minute,
+		ResetAfter:      time.Hour,
+	}
+	ipGuardConfig = LoginGuardConfig{
+		FreeAttempts:    10,
+		LockoutAfter:    50,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutDuration: time.Hour,
+		ResetAfter:      time.Hour,
+	}
+)
+
+type attemptState struct {
+	failures    int
+	lastFailure time.Time
+	nextAllowed time.Time
+	lockedUntil time.Time
+}
+
+// LoginGuard tracks failed logins per key (account or IP) in memory
+type LoginGuard struct {
+	mu      sync.Mutex
+	config  LoginGuardConfig
+	entries map[string]*attemptState
+}
+
+func NewLoginGuard(config LoginGuardConfig) *LoginGuard {
+	return &LoginGuard{
+		config:  config,
+		entries: make(map[string]*attemptState),
+	}
+}
+
+// Check returns how long the caller has to wait before key may try again,
+// zero means the attempt is allowed. expired is true the first time Check is
+// called after a lockout ran out
+func (g *LoginGuard) Check(key string, now time.Time) (wait time.Duration, expired bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	state, ok := g.entries[key]
+	if !ok {
+		return 0, false
+	}
+
+	if !state.lockedUntil.IsZero() {
+		if now.Before(state.lockedUntil) {
+			return state.lockedUntil.Sub(now), false
+		}
+		// The lockout is over, start counting from scratch
+		delete(g.entries, key)
+		return 0, true
+	}
+
+	if now.Sub(state.lastFailure) > g.config.ResetAfter {
+		delete(g.entries, key)
+		return 0, false
+	}
+
+	if now.Before(state.nextAllowed) {
+		return state.nextAllowed.Sub(now), false
+	}
+	return 0, false
+}
+
+// Fail records a failed attempt and reports whether it locked the key
+func (g *LoginGuard) Fail(key string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.pruneLocked(now)
+
+	state, ok := g.entries[key]
+	if !ok {
+		state = &attemptState{}
+		g.entries[key] = state
+	}
+	state.failures++
+	state.lastFailure = now
+
+	if state.failures >= g.config.LockoutAfter {
+		state.lockedUntil = now.Add(g.config.LockoutDuration)
+		return true
+	}
+
+	if over := state.failures - g.config.FreeAttempts; over > 0 {
+		delay := time.Duration(float64(g.config.BaseDelay) * math.Pow(2, float64(over-1)))
+		if delay > g.config.MaxDelay || delay <= 0 {
+			delay = g.config.MaxDelay
+		}
+		state.nextAllowed = now.Add(delay)
+	}
+	return false
+}
+
+// Reset forgets the failures of key, it reports whether key was locked
+func (g *LoginGuard) Reset(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	state, ok := g.entries[key]
+	delete(g.entries, key)
+	return ok && !state.lockedUntil.IsZero()
+}
+
+// pruneLocked drops stale entries so the map can't grow forever, the caller
+// must hold the lock
+func (g *LoginGuard) pruneLocked(now time.Time) {
+	if len(g.entries) < 10000 {
+		return
+	}
+	for key, state := range g.entries {
+		if now.After(state.lockedUntil) && now.Sub(state.lastFailure) > g.config.ResetAfter {
+			delete(g.entries, key)
+		}
+	}
+}
+
+var (
+	accountGuard = NewLoginGuard(accountGuardConfig)
+	ipGuard      = NewLoginGuard(ipGuardConfig)
+)
+
+// ipExtractorFromEnv decides which client IP the per-IP limits see. By default
+// it is the address of the connection, X-Forwarded-For is only trusted from
+// the comma separated CIDRs in TRUSTED_PROXIES
+func ipExtractorFromEnv() (echo.IPExtractor, error) {
+	v := os.Getenv("TRUSTED_PROXIES")
+	if v == "" {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, cidr := range strings.Split(v, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q: %w", cidr, err)
+		}
+		options = append(options, echo.TrustIPRange(network))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+func accountGuardKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// dummyPasswordHash is checked against when the email doesn't exist so a
+// missing account takes as long to reject as a wrong password
+var (
+	dummyHashOnce     sync.Once
+	dummyPasswordHash string
+)
+
+func burnPasswordCheck(password string) {
+	dummyHashOnce.Do(func() {
+		dummyPasswordHash, _ = hashPassword("not-a-real-password")
+	})
+	checkPasswordHash(password, dummyPasswordHash)
+}
+
+// checkLoginAllowed writes a 429 response when the account or IP are in
+// backoff or locked out. It returns true when the login may go ahead. email
+// may be empty to only check the IP
+func checkLoginAllowed(c echo.Context, db *gorm.DB, email string) (bool, error) {
+	now := time.Now()
+	ip := c.RealIP()
+
+	var accountWait time.Duration
+	if email != "" {
+		var accountExpired bool
+		accountWait, accountExpired = accountGuard.Check(accountGuardKey(email), now)
+		if accountExpired {
+			var user User
+			if db.Where("email = ?", email).First(&user).Error == nil {
+				recordAudit(db, AuditAccountUnlocked, &user, ip, "lockout expired")
+			}
+		}
+	}
+	ipWait, _ := ipGuard.Check(ip, now)
+
+	wait := accountWait
+	if ipWait > wait {
+		wait = ipWait
+	}
+	if wait <= 0 {
+		return true, nil
+	}
+
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return false, c.JSON(http.StatusTooManyRequests, map[string]string{
+		"error": "Too many failed login attempts, try again later",
+	})
+}
+
+// recordLoginFailure counts a failed password, 2FA or passkey check against
+// the account and the IP. user may be nil when the email doesn't exist, email
+// may be empty when the account isn't known at all
+func recordLoginFailure(c echo.Context, db *gorm.DB, email string, user *User) {
+	now := time.Now()
+	ip := c.RealIP()
+
+	if email != "" && accountGuard.Fail(accountGuardKey(email), now) && user != nil {
+		recordAudit(db, AuditAccountLocked, user, ip, "too many failed login attempts")
+	}
+	if ipGuard.Fail(ip, now) {
+		recordAudit(db, AuditIPLocked, nil, ip, "too many failed login attempts")
+	}
+}
+
+func recordLoginSuccess(email string) {
+	accountGuard.Reset(accountGuardKey(email))
+}
+
+func adminUnlockUserHandler(c echo.Context, db *gorm.DB) error {
+	var user User
+	if err := db.Where("username = ?", c.Param("username")).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	if accountGuard.Reset(accountGuardKey(user.Email)) {
+		recordAudit(db, AuditAccountUnlocked, &user, c.RealIP(), "unlocked by "+GetUsername(c))
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Account unlocked",
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var testGuardConfig = LoginGuardConfig{
+	FreeAttempts:    2,
+	LockoutAfter:    6,
+	BaseDelay:       time.Second,
+	MaxDelay:        5 * time.Second,
+	LockoutDuration: time.Minute,
+	ResetAfter:      time.Hour,
+}
+
+func TestLoginGuardBackoff(t *testing.T) {
+	guard := NewLoginGuard(testGuardConfig)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// Free attempts, then the delay doubles up to MaxDelay
+	for i, want := range []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second} {
+		if locked := guard.Fail("alice", now); locked {
+			t.Fatalf("failure %d locked the key", i+1)
+		}
+		if wait, _ := guard.Check("alice", now); wait != want {
+			t.Fatalf("wait after failure %d = %v, want %v", i+1, wait, want)
+		}
+		if wait, _ := guard.Check("alice", now.Add(want)); wait != 0 {
+			t.Fatalf("wait after failure %d once the delay passed = %v", i+1, wait)
+		}
+	}
+	if wait, _ := guard.Check("bob", now); wait != 0 {
+		t.Fatalf("unrelated key has to wait %v", wait)
+	}
+
+	capped := LoginGuardConfig{FreeAttempts: 0, LockoutAfter: 100, BaseDelay: time.Second, MaxDelay: 5 * time.Second, ResetAfter: time.Hour}
+	guard = NewLoginGuard(capped)
+	for i := 0; i < 10; i++ {
+		guard.Fail("alice", now)
+	}
+	if wait, _ := guard.Check("alice", now); wait != 5*time.Second {
+		t.Fatalf("wait after 10 failures = %v, want MaxDelay", wait)
+	}
+}
+
+func TestLoginGuardLockout(t *testing.T) {
+	guard := NewLoginGuard(testGuardConfig)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 1; i < testGuardConfig.LockoutAfter; i++ {
+		if guard.Fail("alice", now) {
+			t.Fatalf("failure %d locked the key", i)
+		}
+	}
+	if !guard.Fail("alice", now) {
+		t.Fatalf("failure %d didn't lock the key", testGuardConfig.LockoutAfter)
+	}
+
+	now = now.Add(time.Second)
+	if wait, expired := guard.Check("alice", now); wait != time.Minute-time.Second || expired {
+		t.Fatalf("Check while locked = %v, %v", wait, expired)
+	}
+
+	now = now.Add(time.Minute)
+	if wait, expired := guard.Check("alice", now); wait != 0 || !expired {
+		t.Fatalf("Check after the lockout = %v, %v, want 0, true", wait, expired)
+	}
+	if wait, expired := guard.Check("alice", now); wait != 0 || expired {
+		t.Fatalf("second Check after the lockout = %v, %v, want 0, false", wait, expired)
+	}
+
+	// Counting starts over after a lockout
+	if guard.Fail("alice", now) {
+		t.Fatal("first failure after the lockout locked the key")
+	}
+	if wait, _ := guard.Check("alice", now); wait != 0 {
+		t.Fatalf("first failure after the lockout is delayed %v", wait)
+	}
+}
+
+func TestLoginGuardReset(t *testing.T) {
+	guard := NewLoginGuard(testGuardConfig)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 4; i++ {
+		guard.Fail("alice", now)
+	}
+	if guard.Reset("alice") {
+		t.Fatal("Reset reported a lockout for a key in backoff")
+	}
+	if wait, _ := guard.Check("alice", now); wait != 0 {
+		t.Fatalf("wait after a successful login = %v", wait)
+	}
+	if guard.Reset("alice") {
+		t.Fatal("Reset of an unknown key reported a lockout")
+	}
+
+	for i := 0; i < testGuardConfig.LockoutAfter; i++ {
+		guard.Fail("alice", now)
+	}
+	if !guard.Reset("alice") {
+		t.Fatal("Reset of a locked key didn't report the lockout")
+	}
+	if wait, expired := guard.Check("alice", now); wait != 0 || expired {
+		t.Fatalf("Check after Reset = %v, %v", wait, expired)
+	}
+}
+
+func TestLoginGuardForgetsOldFailures(t *testing.T) {
+	guard := NewLoginGuard(testGuardConfig)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 4; i++ {
+		guard.Fail("alice", now)
+	}
+	now = now.Add(testGuardConfig.ResetAfter + time.Second)
+	if wait, _ := guard.Check("alice", now); wait != 0 {
+		t.Fatalf("wait after ResetAfter = %v", wait)
+	}
+	guard.Fail("alice", now)
+	if wait, _ := guard.Check("alice", now); wait != 0 {
+		t.Fatalf("failures before ResetAfter still count, wait = %v", wait)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends plain text emails to users
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// mailer is the Mailer used by the handlers, replaced in main from the env
+var mailer Mailer = NewLogMailer(os.Stdout)
+
+// smtpMailer sends emails through a regular SMTP server
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTPMailer(host, port, username, password, from string) Mailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &smtpMailer{
+		addr: host + ":" + port,
+		from: from,
+		auth: auth,
+	}
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, buildMessage(m.from, to, subject, body))
+}
+
+// logMailer writes emails to a writer instead of sending them, this is meant
+// for development and tests where there is no mail server around
+type logMailer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewLogMailer(w io.Writer) Mailer {
+	return &logMailer{w: w}
+}
+
+// NewFileMailer appends every email to the file at path
+func NewFileMailer(path string) (Mailer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogMailer(f), nil
+}
+
+func (m *logMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg := buildMessage("noreply@localhost", to, subject, body)
+	_, err := fmt.Fprintf(m.w, "----- email %s -----\n%s\n", time.Now().Format(time.RFC3339), msg)
+	return err
+}
+
+func buildMessage(from, to, subject, body string) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + to + "\r\n")
+	b.WriteString("Subject: " + subject + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(body)
+	return []byte(b.String())
+}
+
+// NewMailerFromEnv picks the mailer from MAIL_DRIVER (smtp, file or log)
+func NewMailerFromEnv() Mailer {
+	switch os.Getenv("MAIL_DRIVER") {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return NewSMTPMailer(
+			os.Getenv("SMTP_HOST"),
+			port,
+			os.Getenv("SMTP_USERNAME"),
+			os.Getenv("SMTP_PASSWORD"),
+			os.Getenv("MAIL_FROM"),
+		)
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			path = "mail.log"
+		}
+		m, err := NewFileMailer(path)
+		if err != nil {
+			log.Printf("failed to open mail file, falling back to stdout: %v", err)
+			return NewLogMailer(os.Stdout)
+		}
+		return m
+	default:
+		return NewLogMailer(os.Stdout)
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo-contrib/echoprometheus"
@@ -30,8 +33,6 @@ func (t *TemplateRenderer) Render(w io.Writer, name string, data interface{}, c
 
 func main() {
 	NewAuth()
-	hub := newHub()
-	go hub.run()
 	err := godotenv.Load()
 	if err != nil {
 		slog.Error("Error loading .env file")
@@ -44,6 +45,28 @@ func main() {
 		slog.Warn("JWT_SECRET not found in env")
 	}
 
+	if baseURL := os.Getenv("APP_BASE_URL"); baseURL != "" {
+		appBaseURL = baseURL
+	}
+	mailer = NewMailerFromEnv()
+	unverifiedPolicy = LoadUnverifiedPolicy()
+	passwordHasher, err = NewPasswordHasherFromEnv()
+	if err != nil {
+		slog.Error("failed to configure password hasher", "error", err)
+		return
+	}
+	passwordPolicy = LoadPasswordPolicy()
+	if corpus := os.Getenv("BREACHED_PASSWORDS_FILE"); corpus != "" {
+		breachChecker = NewKAnonymityChecker(NewFileRangeSource(corpus))
+	}
+	passwordPool = newHashPool(envInt("PASSWORD_HASH_WORKERS", runtime.NumCPU()), 5*time.Second)
+
+	passkeys, err = NewWebAuthnFromEnv()
+	if err != nil {
+		slog.Error("failed to configure webauthn", "error", err)
+		return
+	}
+
 	dsn := os.Getenv("DB_URL")
 	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
 	if err != nil {
@@ -52,9 +75,67 @@ func main() {
 	}
 
 	// Migrate all models
-	db.AutoMigrate(&User{}, &ChatRoom{}, &RoomParticipant{})
+	db.AutoMigrate(&User{}, &ChatRoom{}, &RoomParticipant{}, &UserToken{}, &RecoveryCode{}, &PasskeyCredential{}, &APIToken{}, &AuditLog{}, &Session{}, &RoomBan{}, &ModerationLog{}, &RoomInvite{}, &RoomTag{}, &Achievement{}, &UserAchievement{}, &UserStats{}, &UserDailyActivity{}, &UserRoomActivity{}, &CoinMention{}, &FavoriteCoin{}, &PriceAlert{})
+	promoteAdmins(db, os.Getenv("ADMIN_USERNAMES"))
+	catalogPath := os.Getenv("ACHIEVEMENTS_CATALOG")
+	if catalogPath == "" {
+		catalogPath = "achievements.json"
+	}
+	coinRegistryPath := os.Getenv("COIN_REGISTRY")
+	if coinRegistryPath == "" {
+		coinRegistryPath = "coins.json"
+	}
+	coinRegistry, err = loadCoinRegistry(coinRegistryPath)
+	if err != nil {
+		slog.Error("failed to load coin registry", "error", err)
+		return
+	}
+	if err := setupCoinRooms(db); err != nil {
+		slog.Error("failed to set up coin rooms", "error", err)
+		return
+	}
+	go runCoinMentionWriter(db, coinMentions)
+
+	priceProvider, err := newPriceProviderFromEnv()
+	if err != nil {
+		slog.Error("failed to set up price provider", "error", err)
+		return
+	}
+	prices = NewPriceService(priceProvider, coinRegistry.Coins())
+
+	hub := newHub(db)
+	go hub.run()
+
+	prices.OnUpdate(func(changed []CoinPrice) {
+		hub.prices <- changed
+		queuePriceAlertUpdate(changed)
+	})
+	maxPriceAlerts = envInt("PRICE_ALERTS_PER_USER", maxPriceAlerts)
+	pruneFiredPriceAlerts(db)
+	go runPriceAlertEvaluator(db, hub, priceAlertUpdates)
+	go prices.Run(time.Duration(envInt("PRICE_POLL_SECONDS", 60)) * time.Second)
+
+	stats = NewStatsService(db)
+	go stats.Run(time.Duration(envInt("STATS_FLUSH_SECONDS", 10)) * time.Second)
+
+	achievements, err = NewAchievementService(db, catalogPath, stats)
+	if err != nil {
+		slog.Error("failed to load achievement catalog", "error", err)
+		return
+	}
+	achievements.OnUnlock(func(user *User, achievement Achievement) {
+		invalidateLeaderboards()
+		notifyAchievementUnlock(db, hub, user, achievement)
+	})
+	go runAchievementEvaluator(db, achievements, achievementEvents)
+	go watchAchievementCatalog(achievements, catalogPath, 5*time.Second)
 
 	e := echo.New()
+	e.IPExtractor, err = ipExtractorFromEnv()
+	if err != nil {
+		slog.Error("failed to configure client IPs", "error", err)
+		return
+	}
 
 	// Initialize templates
 	t := &TemplateRenderer{
@@ -93,9 +174,18 @@ func main() {
 	// Auth routes
 	e.POST("/register", func(c echo.Context) error { return registerHandler(c, db) })
 	e.POST("/login", func(c echo.Context) error { return loginHandler(c, db) })
-	e.POST("/logout", func(c echo.Context) error { return logoutHandler(c, db) })
+	e.POST("/login/2fa", func(c echo.Context) error { return loginMFAHandler(c, db) })
+	e.POST("/login/passkey/begin", beginPasskeyLoginHandler)
+	e.POST("/login/passkey/finish", func(c echo.Context) error { return finishPasskeyLoginHandler(c, db) })
+	e.POST("/logout", func(c echo.Context) error { return logoutHandler(c, db, hub) })
 	e.POST("/protected", func(c echo.Context) error { return protectedHandler(c, db) })
 
+	// Email verification and password reset
+	e.GET("/verify-email", func(c echo.Context) error { return verifyEmailHandler(c, db) })
+	e.POST("/password/forgot", func(c echo.Context) error { return forgotPasswordHandler(c, db) })
+	e.GET("/reset-password", func(c echo.Context) error { return c.File("templates/reset_password.html") })
+	e.POST("/password/reset", func(c echo.Context) error { return resetPasswordHandler(c, db, hub) })
+
 	// OAuth routes
 	e.GET("/auth/:provider", func(c echo.Context) error { return oAuthProviderHandler(c) })
 	e.GET("/auth/:provider/callback", func(c echo.Context) error {
@@ -108,19 +198,84 @@ func main() {
 	// Chat room routes
 	e.GET("/rooms", func(c echo.Context) error {
 		return listRoomsHandler(c, db)
-	})
+	}, RequireScope(db, ScopeRoomsRead))
 	e.GET("/rooms/:roomID", func(c echo.Context) error {
 		return getRoomInfoHandler(c, db)
-	})
+	}, RequireScope(db, ScopeRoomsRead))
 	e.POST("/rooms", func(c echo.Context) error {
 		return createRoomHandler(c, db)
-	})
+	}, RequireScope(db, ScopeRoomsWrite))
 	e.POST("/rooms/:roomID/join", func(c echo.Context) error {
 		return joinRoomHandler(c, db)
-	})
+	}, RequireScope(db, ScopeRoomsWrite))
 	e.POST("/rooms/:roomID/leave", func(c echo.Context) error {
 		return leaveRoomHandler(c, db)
-	})
+	}, RequireScope(db, ScopeRoomsWrite))
+	e.PUT("/rooms/:roomID/members/:username/role", func(c echo.Context) error {
+		return setMemberRoleHandler(c, db, hub)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomManageRoles))
+
+	e.PATCH("/rooms/:roomID", func(c echo.Context) error {
+		return updateRoomHandler(c, db, hub)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomManage))
+	e.DELETE("/rooms/:roomID", func(c echo.Context) error {
+		return deleteRoomHandler(c, db, hub)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomDelete))
+	e.PUT("/rooms/:roomID/topic", func(c echo.Context) error {
+		return setRoomTopicHandler(c, db, hub)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomModerate))
+	e.POST("/rooms/:roomID/archive", func(c echo.Context) error {
+		return archiveRoomHandler(c, db, hub, true)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomManage))
+	e.DELETE("/rooms/:roomID/archive", func(c echo.Context) error {
+		return archiveRoomHandler(c, db, hub, false)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomManage))
+	e.POST("/rooms/:roomID/transfer", func(c echo.Context) error {
+		return transferRoomHandler(c, db, hub)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomTransfer))
+
+	e.GET("/rooms/:roomID/invites", func(c echo.Context) error {
+		return listInvitesHandler(c, db)
+	}, RequireScope(db, ScopeRoomsRead), RequireRoomPermission(db, PermRoomManage))
+	e.POST("/rooms/:roomID/invites", func(c echo.Context) error {
+		return createInviteHandler(c, db)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomManage))
+	e.DELETE("/rooms/:roomID/invites/:id", func(c echo.Context) error {
+		return revokeInviteHandler(c, db)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomManage))
+	e.POST("/invites/:code/accept", func(c echo.Context) error {
+		return acceptInviteHandler(c, db)
+	}, RequireScope(db, ScopeRoomsWrite))
+
+	e.GET("/rooms/:roomID/coins/trending", func(c echo.Context) error {
+		return roomTrendingCoinsHandler(c, db)
+	}, RequireScope(db, ScopeRoomsRead), RequireRoomPermission(db, PermRoomRead))
+
+	// Room moderation
+	e.POST("/rooms/:roomID/kick", func(c echo.Context) error {
+		return kickHandler(c, db, hub)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomModerate))
+	e.GET("/rooms/:roomID/bans", func(c echo.Context) error {
+		return listBansHandler(c, db)
+	}, RequireScope(db, ScopeRoomsRead), RequireRoomPermission(db, PermRoomModerate))
+	e.POST("/rooms/:roomID/bans", func(c echo.Context) error {
+		return banHandler(c, db, hub)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomModerate))
+	e.DELETE("/rooms/:roomID/bans/:username", func(c echo.Context) error {
+		return unbanHandler(c, db)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomModerate))
+	e.POST("/rooms/:roomID/mutes", func(c echo.Context) error {
+		return muteHandler(c, db, hub)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomModerate))
+	e.DELETE("/rooms/:roomID/mutes/:username", func(c echo.Context) error {
+		return unmuteHandler(c, db, hub)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomModerate))
+	e.PUT("/rooms/:roomID/slow-mode", func(c echo.Context) error {
+		return slowModeHandler(c, db, hub)
+	}, RequireScope(db, ScopeRoomsWrite), RequireRoomPermission(db, PermRoomModerate))
+	e.GET("/rooms/:roomID/moderation-log", func(c echo.Context) error {
+		return moderationLogHandler(c, db)
+	}, RequireScope(db, ScopeRoomsRead), RequireRoomPermission(db, PermRoomModerate))
 
 	// Create a URL to view a specific room
 	e.GET("/chat/:roomID", func(c echo.Context) error {
@@ -129,10 +284,16 @@ func main() {
 
 		// Render the template with the room ID
 		return c.Render(http.StatusOK, "chat_room.html", map[string]interface{}{
-			"RoomID": roomID,
+			"RoomID":     roomID,
+			"InviteCode": "",
 		})
 	})
 
+	// Invite links land on the room page, which then accepts the invite
+	e.GET("/invite/:code", func(c echo.Context) error {
+		return inviteLandingHandler(c, db)
+	})
+
 	// Create a URL for the room creation page
 	e.GET("/create-room", func(c echo.Context) error {
 		// Serve the room creation page HTML
@@ -151,12 +312,109 @@ func main() {
 			return next(c)
 		}
 	})
-	protectedGroup.GET("/profile", profileHandler)
+	protectedGroup.GET("/profile", profileHandler, RequireScope(db, ScopeProfileRead))
 	protectedGroup.GET("/user/:username", func(c echo.Context) error {
 		return getUserHandler(c)
-	})
+	}, RequireScope(db, ScopeProfileRead))
+	protectedGroup.PUT("/achievements/announce", func(c echo.Context) error {
+		return setAnnounceAchievementsHandler(c, db)
+	}, RequireScope(db, ScopeProfileWrite))
+	protectedGroup.GET("/users/:username/achievements", func(c echo.Context) error {
+		return getUserAchievements(c, db)
+	}, RequireScope(db, ScopeProfileRead))
+	protectedGroup.GET("/users/:username/stats", func(c echo.Context) error {
+		return getUserStatsHandler(c, db)
+	}, RequireScope(db, ScopeProfileRead))
+	protectedGroup.GET("/leaderboards/:metric", func(c echo.Context) error {
+		return leaderboardHandler(c, db)
+	}, RequireScope(db, ScopeProfileRead))
+	protectedGroup.GET("/users/:username/coins", func(c echo.Context) error {
+		return getUserCoins(c, db)
+	}, RequireScope(db, ScopeProfileRead))
+	protectedGroup.GET("/users/:username/coins/most-active", func(c echo.Context) error {
+		return userMostActiveCoins(c, db)
+	}, RequireScope(db, ScopeProfileRead))
+	protectedGroup.PUT("/coins/:symbol/favorite", func(c echo.Context) error {
+		return favoriteCoinHandler(c, db, true)
+	}, RequireScope(db, ScopeProfileWrite))
+	protectedGroup.DELETE("/coins/:symbol/favorite", func(c echo.Context) error {
+		return favoriteCoinHandler(c, db, false)
+	}, RequireScope(db, ScopeProfileWrite))
+	protectedGroup.GET("/coins/trending", func(c echo.Context) error {
+		return trendingCoinsHandler(c, db)
+	}, RequireScope(db, ScopeProfileRead))
+	protectedGroup.GET("/alerts", func(c echo.Context) error {
+		return listPriceAlertsHandler(c, db)
+	}, RequireScope(db, ScopeProfileRead))
+	protectedGroup.POST("/alerts", func(c echo.Context) error {
+		return createPriceAlertHandler(c, db)
+	}, RequireScope(db, ScopeProfileWrite))
+	protectedGroup.DELETE("/alerts/:id", func(c echo.Context) error {
+		return deletePriceAlertHandler(c, db)
+	}, RequireScope(db, ScopeProfileWrite))
 	protectedGroup.GET("/my-rooms", func(c echo.Context) error {
 		return getUserRoomsHandler(c, db)
+	}, RequireScope(db, ScopeRoomsRead))
+	protectedGroup.POST("/verify-email/resend", func(c echo.Context) error {
+		return resendVerificationHandler(c, db)
+	}, RejectAPITokens())
+
+	// Two-factor authentication
+	protectedGroup.POST("/2fa/enroll", func(c echo.Context) error {
+		return enrollTOTPHandler(c, db)
+	}, RejectAPITokens())
+	protectedGroup.POST("/2fa/confirm", func(c echo.Context) error {
+		return confirmTOTPHandler(c, db)
+	}, RejectAPITokens())
+	protectedGroup.POST("/2fa/disable", func(c echo.Context) error {
+		return disableTOTPHandler(c, db)
+	}, RejectAPITokens())
+	protectedGroup.POST("/2fa/recovery-codes", func(c echo.Context) error {
+		return regenerateRecoveryCodesHandler(c, db)
+	}, RejectAPITokens())
+
+	// Passkeys
+	protectedGroup.GET("/passkeys", func(c echo.Context) error {
+		return listPasskeysHandler(c, db)
+	}, RejectAPITokens())
+	protectedGroup.POST("/passkeys/register/begin", func(c echo.Context) error {
+		return beginPasskeyRegistrationHandler(c, db)
+	}, RejectAPITokens())
+	protectedGroup.POST("/passkeys/register/finish", func(c echo.Context) error {
+		return finishPasskeyRegistrationHandler(c, db)
+	}, RejectAPITokens())
+	protectedGroup.DELETE("/passkeys/:id", func(c echo.Context) error {
+		return deletePasskeyHandler(c, db)
+	}, RejectAPITokens())
+
+	// Sessions
+	protectedGroup.GET("/sessions", func(c echo.Context) error {
+		return listSessionsHandler(c, db)
+	}, RejectAPITokens())
+	protectedGroup.DELETE("/sessions/:id", func(c echo.Context) error {
+		return revokeSessionHandler(c, db, hub)
+	}, RejectAPITokens())
+
+	// API tokens
+	protectedGroup.GET("/tokens", func(c echo.Context) error {
+		return listAPITokensHandler(c, db)
+	}, RejectAPITokens())
+	protectedGroup.POST("/tokens", func(c echo.Context) error {
+		return createAPITokenHandler(c, db)
+	}, RejectAPITokens())
+	protectedGroup.DELETE("/tokens/:id", func(c echo.Context) error {
+		return revokeAPITokenHandler(c, db)
+	}, RejectAPITokens())
+
+	// Admin API routes
+	adminGroup := protectedGroup.Group("/admin")
+	adminGroup.Use(RequireScope(db, ScopeAdmin))
+	adminGroup.Use(RequireGlobalRole(db, RoleAdmin))
+	adminGroup.POST("/users/:username/2fa/reset", func(c echo.Context) error {
+		return adminResetTOTPHandler(c, db)
+	})
+	adminGroup.POST("/users/:username/unlock", func(c echo.Context) error {
+		return adminUnlockUserHandler(c, db)
 	})
 
 	if err := e.Start(":8080"); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -187,3 +445,17 @@ func getUserRoomsHandler(c echo.Context, db *gorm.DB) error {
 
 	return c.JSON(http.StatusOK, rooms)
 }
+
+// promoteAdmins marks the comma separated usernames as admins so there is a
+// way to bootstrap the first admin account
+func promoteAdmins(db *gorm.DB, usernames string) {
+	for _, username := range strings.Split(usernames, ",") {
+		username = strings.TrimSpace(username)
+		if username == "" {
+			continue
+		}
+		if err := db.Model(&User{}).Where("username = ?", username).Update("role", RoleAdmin).Error; err != nil {
+			slog.Error("failed to promote admin", "username", username, "error", err)
+		}
+	}
+}
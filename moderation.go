@@ -0,0 +1,448 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Moderation actions, stored in ModerationLog.Action
+const (
+	ModActionKick     = "kick"
+	ModActionBan      = "ban"
+	ModActionUnban    = "unban"
+	ModActionMute     = "mute"
+	ModActionUnmute   = "unmute"
+	ModActionSlowMode = "slow_mode"
+)
+
+const maxSlowModeSeconds = 3600
+
+// permanentUntil stands in for "forever" in mute expiry columns
+var permanentUntil = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var (
+	ErrUserNotFound   = errors.New("user not found")
+	ErrCannotModerate = errors.New("you can't moderate this user")
+	ErrNotBanned      = errors.New("user is not banned")
+	ErrNotParticipant = errors.New("user is not a participant of this room")
+	ErrInvalidInput   = errors.New("invalid input")
+)
+
+// RoomBan keeps a user out of a room until ExpiresAt, or forever when nil
+type RoomBan struct {
+	gorm.Model
+	RoomID    uint       `gorm:"index" json:"-"`
+	UserID    uint       `gorm:"index" json:"-"`
+	BannedBy  uint       `json:"-"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// ModerationLog records every moderation action taken in a room
+type ModerationLog struct {
+	gorm.Model
+	RoomID   uint   `gorm:"index" json:"-"`
+	ActorID  uint   `json:"-"`
+	TargetID uint   `json:"-"`
+	Action   string `gorm:"size:32" json:"action"`
+	Reason   string `json:"reason,omitempty"`
+	Duration int64  `json:"duration_seconds,omitempty"` // 0 means permanent or not applicable
+}
+
+func logModeration(db *gorm.DB, room *ChatRoom, actor, target *User, action, reason string, duration time.Duration) {
+	entry := &ModerationLog{
+		RoomID:   room.ID,
+		ActorID:  actor.ID,
+		Action:   action,
+		Reason:   reason,
+		Duration: int64(duration.Seconds()),
+	}
+	if target != nil {
+		entry.TargetID = target.ID
+	}
+	db.Create(entry)
+}
+
+// activeBan returns the ban keeping userID out of the room, if any
+func activeBan(db *gorm.DB, roomID, userID uint) *RoomBan {
+	var ban RoomBan
+	err := db.Where("room_id = ? AND user_id = ? AND (expires_at IS NULL OR expires_at > ?)", roomID, userID, time.Now()).
+		First(&ban).Error
+	if err != nil {
+		return nil
+	}
+	return &ban
+}
+
+// parseModerationDuration accepts Go durations plus a "d" suffix for days. An
+// empty string means permanent and returns 0
+func parseModerationDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "perm" || s == "permanent" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 {
+			return 0, ErrInvalidInput
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, ErrInvalidInput
+	}
+	return d, nil
+}
+
+func describeDuration(d time.Duration) string {
+	if d == 0 {
+		return "permanently"
+	}
+	return "for " + d.String()
+}
+
+// moderationTarget loads the target user and checks that actor outranks them
+// in the room
+func moderationTarget(db *gorm.DB, room *ChatRoom, actor *User, username string) (*User, error) {
+	var target User
+	if err := db.Where("username = ?", username).First(&target).Error; err != nil {
+		return nil, ErrUserNotFound
+	}
+	if target.ID == actor.ID || !outranks(db, room, actor, &target) {
+		return nil, ErrCannotModerate
+	}
+	return &target, nil
+}
+
+// outranks reports whether actor has a higher role than target in room
+func outranks(db *gorm.DB, room *ChatRoom, actor, target *User) bool {
+	return roomRoleRank[RoomRoleOf(db, actor, room)] > roomRoleRank[RoomRoleOf(db, target, room)]
+}
+
+// setMutedUntil stores the mute of a participant, nil unmutes. The participant
+// is looked up first because MySQL reports 0 affected rows for an UPDATE that
+// leaves the value unchanged, so RowsAffected can't tell a missing participant
+// from a repeated mute or unmute
+func setMutedUntil(db *gorm.DB, room *ChatRoom, target *User, until *time.Time) error {
+	var participant RoomParticipant
+	if err := db.Where("room_id = ? AND user_id = ?", room.ID, target.ID).First(&participant).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotParticipant
+		}
+		return err
+	}
+	return db.Model(&RoomParticipant{}).
+		Where("room_id = ? AND user_id = ?", room.ID, target.ID).
+		Update("muted_until", until).Error
+}
+
+// kickUser disconnects the target from the room and drops their membership
+func kickUser(db *gorm.DB, hub *Hub, room *ChatRoom, actor *User, username, reason string) (*User, error) {
+	target, err := moderationTarget(db, room, actor, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Where("room_id = ? AND user_id = ?", room.ID, target.ID).Delete(&RoomParticipant{}).Error; err != nil {
+		return nil, err
+	}
+
+	logModeration(db, room, actor, target, ModActionKick, reason, 0)
+	hub.roomEvents <- &RoomEvent{
+		Kind:    RoomEventKick,
+		RoomID:  room.RoomID,
+		UserID:  target.ID,
+		Message: fmt.Sprintf("%s was kicked by %s", target.Username, actor.Username),
+	}
+	return target, nil
+}
+
+// banUser kicks the target and keeps them out for duration, 0 is permanent
+func banUser(db *gorm.DB, hub *Hub, room *ChatRoom, actor *User, username string, duration time.Duration, reason string) (*User, error) {
+	target, err := moderationTarget(db, room, actor, username)
+	if err != nil {
+		return nil, err
+	}
+
+	ban := &RoomBan{
+		RoomID:   room.ID,
+		UserID:   target.ID,
+		BannedBy: actor.ID,
+		Reason:   reason,
+	}
+	if duration > 0 {
+		expires := time.Now().Add(duration)
+		ban.ExpiresAt = &expires
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// A new ban replaces any older one
+		if err := tx.Where("room_id = ? AND user_id = ?", room.ID, target.ID).Delete(&RoomBan{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(ban).Error; err != nil {
+			return err
+		}
+		return tx.Where("room_id = ? AND user_id = ?", room.ID, target.ID).Delete(&RoomParticipant{}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logModeration(db, room, actor, target, ModActionBan, reason, duration)
+	hub.roomEvents <- &RoomEvent{
+		Kind:    RoomEventKick,
+		RoomID:  room.RoomID,
+		UserID:  target.ID,
+		Message: fmt.Sprintf("%s was banned %s by %s", target.Username, describeDuration(duration), actor.Username),
+	}
+	return target, nil
+}
+
+func unbanUser(db *gorm.DB, room *ChatRoom, actor *User, username string) (*User, error) {
+	target, err := moderationTarget(db, room, actor, username)
+	if err != nil {
+		return nil, err
+	}
+
+	result := db.Where("room_id = ? AND user_id = ?", room.ID, target.ID).Delete(&RoomBan{})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrNotBanned
+	}
+
+	logModeration(db, room, actor, target, ModActionUnban, "", 0)
+	return target, nil
+}
+
+// muteUser stops the target from sending messages for duration, 0 is
+// permanent. They can still read the room
+func muteUser(db *gorm.DB, hub *Hub, room *ChatRoom, actor *User, username string, duration time.Duration, reason string) (*User, error) {
+	target, err := moderationTarget(db, room, actor, username)
+	if err != nil {
+		return nil, err
+	}
+
+	until := permanentUntil
+	if duration > 0 {
+		until = time.Now().Add(duration)
+	}
+
+	if err := setMutedUntil(db, room, target, &until); err != nil {
+		return nil, err
+	}
+
+	logModeration(db, room, actor, target, ModActionMute, reason, duration)
+	hub.roomEvents <- &RoomEvent{
+		Kind:    RoomEventMute,
+		RoomID:  room.RoomID,
+		UserID:  target.ID,
+		Until:   until,
+		Message: fmt.Sprintf("%s was muted %s by %s", target.Username, describeDuration(duration), actor.Username),
+	}
+	return target, nil
+}
+
+func unmuteUser(db *gorm.DB, hub *Hub, room *ChatRoom, actor *User, username string) (*User, error) {
+	target, err := moderationTarget(db, room, actor, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setMutedUntil(db, room, target, nil); err != nil {
+		return nil, err
+	}
+
+	logModeration(db, room, actor, target, ModActionUnmute, "", 0)
+	hub.roomEvents <- &RoomEvent{
+		Kind:    RoomEventUnmute,
+		RoomID:  room.RoomID,
+		UserID:  target.ID,
+		Message: fmt.Sprintf("%s was unmuted by %s", target.Username, actor.Username),
+	}
+	return target, nil
+}
+
+// setSlowMode limits every member to one message per seconds, 0 turns slow
+// mode off
+func setSlowMode(db *gorm.DB, hub *Hub, room *ChatRoom, actor *User, seconds int) error {
+	if seconds < 0 || seconds > maxSlowModeSeconds {
+		return ErrInvalidInput
+	}
+
+	if err := db.Model(room).Update("slow_mode_seconds", seconds).Error; err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("%s turned off slow mode", actor.Username)
+	if seconds > 0 {
+		message = fmt.Sprintf("%s turned on slow mode: one message every %ds", actor.Username, seconds)
+	}
+
+	logModeration(db, room, actor, nil, ModActionSlowMode, "", time.Duration(seconds)*time.Second)
+	hub.roomEvents <- &RoomEvent{
+		Kind:     RoomEventSlowMode,
+		RoomID:   room.RoomID,
+		SlowMode: time.Duration(seconds) * time.Second,
+		Message:  message,
+	}
+	return nil
+}
+
+// moderationErrorResponse maps the moderation errors to a JSON response
+func moderationErrorResponse(c echo.Context, err error) error {
+	status := http.StatusInternalServerError
+	message := "Moderation action failed"
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		status, message = http.StatusNotFound, "User not found"
+	case errors.Is(err, ErrCannotModerate):
+		status, message = http.StatusForbidden, "You can't moderate this user"
+	case errors.Is(err, ErrNotBanned):
+		status, message = http.StatusNotFound, "User is not banned"
+	case errors.Is(err, ErrNotParticipant):
+		status, message = http.StatusNotFound, "User is not a participant of this room"
+	case errors.Is(err, ErrInvalidInput):
+		status, message = http.StatusBadRequest, "Invalid duration or value"
+	}
+	return c.JSON(status, map[string]string{
+		"error": message,
+	})
+}
+
+func kickHandler(c echo.Context, db *gorm.DB, hub *Hub) error {
+	actor, room := contextUserAndRoom(c)
+	target, err := kickUser(db, hub, room, actor, c.FormValue("username"), c.FormValue("reason"))
+	if err != nil {
+		return moderationErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": target.Username + " was kicked",
+	})
+}
+
+func banHandler(c echo.Context, db *gorm.DB, hub *Hub) error {
+	actor, room := contextUserAndRoom(c)
+	duration, err := parseModerationDuration(c.FormValue("duration"))
+	if err != nil {
+		return moderationErrorResponse(c, err)
+	}
+	target, err := banUser(db, hub, room, actor, c.FormValue("username"), duration, c.FormValue("reason"))
+	if err != nil {
+		return moderationErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": target.Username + " was banned " + describeDuration(duration),
+	})
+}
+
+func unbanHandler(c echo.Context, db *gorm.DB) error {
+	actor, room := contextUserAndRoom(c)
+	target, err := unbanUser(db, room, actor, c.Param("username"))
+	if err != nil {
+		return moderationErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": target.Username + " was unbanned",
+	})
+}
+
+func listBansHandler(c echo.Context, db *gorm.DB) error {
+	_, room := contextUserAndRoom(c)
+
+	type banRow struct {
+		Username  string     `json:"username"`
+		Reason    string     `json:"reason"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		CreatedAt time.Time  `json:"created_at"`
+	}
+	var bans []banRow
+	if err := db.Table("room_bans").
+		Select("users.username, room_bans.reason, room_bans.expires_at, room_bans.created_at").
+		Joins("JOIN users ON users.id = room_bans.user_id").
+		Where("room_bans.room_id = ? AND room_bans.deleted_at IS NULL AND (room_bans.expires_at IS NULL OR room_bans.expires_at > ?)", room.ID, time.Now()).
+		Scan(&bans).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch bans",
+		})
+	}
+	return c.JSON(http.StatusOK, bans)
+}
+
+func muteHandler(c echo.Context, db *gorm.DB, hub *Hub) error {
+	actor, room := contextUserAndRoom(c)
+	duration, err := parseModerationDuration(c.FormValue("duration"))
+	if err != nil {
+		return moderationErrorResponse(c, err)
+	}
+	target, err := muteUser(db, hub, room, actor, c.FormValue("username"), duration, c.FormValue("reason"))
+	if err != nil {
+		return moderationErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": target.Username + " was muted " + describeDuration(duration),
+	})
+}
+
+func unmuteHandler(c echo.Context, db *gorm.DB, hub *Hub) error {
+	actor, room := contextUserAndRoom(c)
+	target, err := unmuteUser(db, hub, room, actor, c.Param("username"))
+	if err != nil {
+		return moderationErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": target.Username + " was unmuted",
+	})
+}
+
+func slowModeHandler(c echo.Context, db *gorm.DB, hub *Hub) error {
+	actor, room := contextUserAndRoom(c)
+	seconds, err := strconv.Atoi(c.FormValue("seconds"))
+	if err != nil {
+		return moderationErrorResponse(c, ErrInvalidInput)
+	}
+	if err := setSlowMode(db, hub, room, actor, seconds); err != nil {
+		return moderationErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":           "Slow mode updated",
+		"slow_mode_seconds": seconds,
+	})
+}
+
+func moderationLogHandler(c echo.Context, db *gorm.DB) error {
+	_, room := contextUserAndRoom(c)
+
+	type logRow struct {
+		Action    string    `json:"action"`
+		Actor     string    `json:"actor"`
+		Target    string    `json:"target,omitempty"`
+		Reason    string    `json:"reason,omitempty"`
+		Duration  int64     `json:"duration_seconds,omitempty"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	var entries []logRow
+	if err := db.Table("moderation_logs").
+		Select("moderation_logs.action, actors.username AS actor, targets.username AS target, moderation_logs.reason, moderation_logs.duration, moderation_logs.created_at").
+		Joins("JOIN users actors ON actors.id = moderation_logs.actor_id").
+		Joins("LEFT JOIN users targets ON targets.id = moderation_logs.target_id").
+		Where("moderation_logs.room_id = ?", room.ID).
+		Order("moderation_logs.created_at desc").
+		Limit(200).
+		Scan(&entries).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch moderation log",
+		})
+	}
+	return c.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const ceremonyTTL = 5 * time.Minute
+
+// PasskeyCredential is a WebAuthn credential registered by a user
+type PasskeyCredential struct {
+	gorm.Model
+	UserID          uint       `gorm:"index" json:"-"`
+	Name            string     `json:"name"`
+	CredentialID    string     `gorm:"size:255;uniqueIndex" json:"credential_id"` // base64url
+	PublicKey       []byte     `json:"-"`
+	AttestationType string     `json:"-"`
+	Transports      string     `json:"transports"` // comma separated
+	AAGUID          []byte     `json:"-"`
+	SignCount       uint32     `json:"-"`
+	BackupEligible  bool       `json:"backup_eligible"`
+	BackupState     bool       `json:"backup_state"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+}
+
+func (p *PasskeyCredential) toWebAuthn() webauthn.Credential {
+	id, _ := base64.RawURLEncoding.DecodeString(p.CredentialID)
+	var transports []protocol.AuthenticatorTransport
+	for _, t := range strings.Split(p.Transports, ",") {
+		if t != "" {
+			transports = append(transports, protocol.AuthenticatorTransport(t))
+		}
+	}
+	return webauthn.Credential{
+		ID:              id,
+		PublicKey:       p.PublicKey,
+		AttestationType: p.AttestationType,
+		Transport:       transports,
+		Flags: webauthn.CredentialFlags{
+			BackupEligible: p.BackupEligible,
+			BackupState:    p.BackupState,
+		},
+		Authenticator: webauthn.Authenticator{
+			AAGUID:    p.AAGUID,
+			SignCount: p.SignCount,
+		},
+	}
+}
+
+// passkeyUser adapts a User and its credentials to webauthn.User
+type passkeyUser struct {
+	user        *User
+	credentials []PasskeyCredential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	return []byte(u.user.PasskeyHandle)
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(u.credentials))
+	for i := range u.credentials {
+		creds = append(creds, u.credentials[i].toWebAuthn())
+	}
+	return creds
+}
+
+func loadPasskeyUser(db *gorm.DB, user *User) (*passkeyUser, error) {
+	var creds []PasskeyCredential
+	if err := db.Where("user_id = ?", user.ID).Find(&creds).Error; err != nil {
+		return nil, err
+	}
+	return &passkeyUser{user: user, credentials: creds}, nil
+}
+
+// ensurePasskeyHandle gives the user a random WebAuthn user handle the first
+// time they register a passkey. The handle must not contain personal data
+func ensurePasskeyHandle(db *gorm.DB, user *User) error {
+	if user.PasskeyHandle != "" {
+		return nil
+	}
+	handle, err := generateToken(32)
+	if err != nil {
+		return err
+	}
+	if err := db.Model(user).Update("passkey_handle", handle).Error; err != nil {
+		return err
+	}
+	user.PasskeyHandle = handle
+	return nil
+}
+
+// ceremonyStore keeps the WebAuthn session data between the begin and finish
+// requests of a ceremony
+type ceremonyStore struct {
+	mu       sync.Mutex
+	sessions map[string]ceremony
+}
+
+type ceremony struct {
+	userID  uint
+	session webauthn.SessionData
+	expires time.Time
+}
+
+func newCeremonyStore() *ceremonyStore {
+	return &ceremonyStore{sessions: make(map[string]ceremony)}
+}
+
+func (s *ceremonyStore) put(userID uint, session *webauthn.SessionData) (string, error) {
+	id, err := generateToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, c := range s.sessions {
+		if now.After(c.expires) {
+			delete(s.sessions, key)
+		}
+	}
+	s.sessions[id] = ceremony{userID: userID, session: *session, expires: now.Add(ceremonyTTL)}
+	return id, nil
+}
+
+// take returns the ceremony and removes it so it can only be finished once
+func (s *ceremonyStore) take(id string) (ceremony, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.sessions[id]
+	delete(s.sessions, id)
+	if !ok || time.Now().After(c.expires) {
+		return ceremony{}, false
+	}
+	return c, true
+}
+
+var (
+	passkeys   *webauthn.WebAuthn
+	ceremonies = newCeremonyStore()
+)
+
+// NewWebAuthnFromEnv configures the relying party from WEBAUTHN_RP_ID and the
+// comma separated WEBAUTHN_RP_ORIGINS, defaulting to the app base url
+func NewWebAuthnFromEnv() (*webauthn.WebAuthn, error) {
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		rpID = "localhost"
+	}
+
+	origins := []string{appBaseURL}
+	if v := os.Getenv("WEBAUTHN_RP_ORIGINS"); v != "" {
+		origins = strings.Split(v, ",")
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPDisplayName: "Auth Chat",
+		RPID:          rpID,
+		RPOrigins:     origins,
+	})
+}
+
+func beginPasskeyRegistrationHandler(c echo.Context, db *gorm.DB) error {
+	username := GetUsername(c)
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	if err := ensurePasskeyHandle(db, &user); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to start passkey registration",
+		})
+	}
+
+	pkUser, err := loadPasskeyUser(db, &user)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load passkeys",
+		})
+	}
+
+	// Exclude existing credentials so the same authenticator isn't registered twice
+	exclude := make([]protocol.CredentialDescriptor, 0, len(pkUser.credentials))
+	for _, cred := range pkUser.WebAuthnCredentials() {
+		exclude = append(exclude, cred.Descriptor())
+	}
+
+	options, session, err := passkeys.BeginRegistration(pkUser,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(exclude),
+	)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to start passkey registration",
+		})
+	}
+
+	ceremonyID, err := ceremonies.put(user.ID, session)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to start passkey registration",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"ceremony_id": ceremonyID,
+		"options":     options,
+	})
+}
+
+func finishPasskeyRegistrationHandler(c echo.Context, db *gorm.DB) error {
+	username := GetUsername(c)
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	cer, ok := ceremonies.take(c.QueryParam("ceremony_id"))
+	if !ok || cer.userID != user.ID {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Registration expired, please try again",
+		})
+	}
+
+	pkUser, err := loadPasskeyUser(db, &user)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load passkeys",
+		})
+	}
+
+	credential, err := passkeys.FinishRegistration(pkUser, cer.session, c.Request())
+	if err != nil {
+		log.Printf("passkey registration failed for %s: %v", user.Username, err)
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Passkey registration failed",
+		})
+	}
+
+	name := c.QueryParam("name")
+	if name == "" {
+		name = "Passkey"
+	}
+
+	transports := make([]string, 0, len(credential.Transport))
+	for _, t := range credential.Transport {
+		transports = append(transports, string(t))
+	}
+
+	record := &PasskeyCredential{
+		UserID:          user.ID,
+		Name:            name,
+		CredentialID:    base64.RawURLEncoding.EncodeToString(credential.ID),
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      strings.Join(transports, ","),
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}
+	if err := db.Create(record).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save passkey",
+		})
+	}
+
+	publishAchievementEvent(user.ID, MetricPasskeys, MetricTwoFactor)
+
+	return c.JSON(http.StatusCreated, record)
+}
+
+func beginPasskeyLoginHandler(c echo.Context) error {
+	options, session, err := passkeys.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to start passkey login",
+		})
+	}
+
+	ceremonyID, err := ceremonies.put(0, session)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to start passkey login",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"ceremony_id": ceremonyID,
+		"options":     options,
+	})
+}
+
+// passkeyLoginAllowed applies the same rules as password login once the
+// passkey told us who is signing in: lockouts, backoff and unverified emails
+func passkeyLoginAllowed(c echo.Context, db *gorm.DB, user *User) (bool, error) {
+	if ok, err := checkLoginAllowed(c, db, user.Email); !ok {
+		return false, err
+	}
+	if !verifiedOrAllowed(user, unverifiedPolicy.CanLogin) {
+		return false, c.JSON(http.StatusForbidden, map[string]string{
+			"error": "You must verify your email before logging in",
+		})
+	}
+	return true, nil
+}
+
+func finishPasskeyLoginHandler(c echo.Context, db *gorm.DB) error {
+	// The account isn't known until the assertion is checked, the IP is
+	if ok, err := checkLoginAllowed(c, db, ""); !ok {
+		return err
+	}
+
+	cer, ok := ceremonies.take(c.QueryParam("ceremony_id"))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Login expired, please try again",
+		})
+	}
+
+	var loggedIn *passkeyUser
+	credential, err := passkeys.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		var user User
+		if err := db.Where("passkey_handle = ?", string(userHandle)).First(&user).Error; err != nil {
+			return nil, err
+		}
+		pkUser, err := loadPasskeyUser(db, &user)
+		if err != nil {
+			return nil, err
+		}
+		loggedIn = pkUser
+		return pkUser, nil
+	}, cer.session, c.Request())
+	if err != nil || loggedIn == nil {
+		if loggedIn != nil {
+			recordLoginFailure(c, db, loggedIn.user.Email, loggedIn.user)
+		} else {
+			recordLoginFailure(c, db, "", nil)
+		}
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Passkey login failed",
+		})
+	}
+
+	credentialID := base64.RawURLEncoding.EncodeToString(credential.ID)
+	var stored *PasskeyCredential
+	for i := range loggedIn.credentials {
+		if loggedIn.credentials[i].CredentialID == credentialID {
+			stored = &loggedIn.credentials[i]
+			break
+		}
+	}
+	if stored == nil {
+		recordLoginFailure(c, db, loggedIn.user.Email, loggedIn.user)
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Passkey login failed",
+		})
+	}
+
+	// A sign count that didn't go up means the credential may have been cloned
+	if credential.Authenticator.CloneWarning {
+		log.Printf("passkey %d of %s reported a sign count that did not increase, rejecting login", stored.ID, loggedIn.user.Username)
+		recordLoginFailure(c, db, loggedIn.user.Email, loggedIn.user)
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Passkey login failed",
+		})
+	}
+
+	now := time.Now()
+	db.Model(stored).Updates(map[string]interface{}{
+		"sign_count":   credential.Authenticator.SignCount,
+		"backup_state": credential.Flags.BackupState,
+		"last_used_at": now,
+	})
+
+	if ok, err := passkeyLoginAllowed(c, db, loggedIn.user); !ok {
+		return err
+	}
+	recordLoginSuccess(loggedIn.user.Email)
+
+	return issueLoginToken(c, db, loggedIn.user)
+}
+
+func listPasskeysHandler(c echo.Context, db *gorm.DB) error {
+	username := GetUsername(c)
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	var creds []PasskeyCredential
+	if err := db.Where("user_id = ?", user.ID).Find(&creds).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch passkeys",
+		})
+	}
+
+	return c.JSON(http.StatusOK, creds)
+}
+
+func deletePasskeyHandler(c echo.Context, db *gorm.DB) error {
+	username := GetUsername(c)
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	result := db.Unscoped().Where("id = ? AND user_id = ?", c.Param("id"), user.ID).Delete(&PasskeyCredential{})
+	if result.Error != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to delete passkey",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Passkey not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Passkey deleted",
+	})
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost:8080"
+)
+
+// softwareAuthenticator is a platform authenticator in memory. It makes
+// "none" attestations and ES256 assertions
+type softwareAuthenticator struct {
+	t          *testing.T
+	key        *ecdsa.PrivateKey
+	credID     []byte
+	userHandle []byte
+	signCount  uint32
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credID := make([]byte, 16)
+	rand.Read(credID)
+	return &softwareAuthenticator{t: t, key: key, credID: credID}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (a *softwareAuthenticator) clientData(kind, challenge string) []byte {
+	data, err := json.Marshal(map[string]string{
+		"type":      kind,
+		"challenge": challenge,
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return data
+}
+
+// authData builds authenticator data, with the attested credential when
+// attested is set
+func (a *softwareAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	flags := byte(protocol.FlagUserPresent | protocol.FlagUserVerified)
+	if attested {
+		flags |= byte(protocol.FlagAttestedCredentialData)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(rpIDHash[:])
+	buf.WriteByte(flags)
+	binary.Write(&buf, binary.BigEndian, a.signCount)
+	if attested {
+		buf.Write(make([]byte, 16)) // AAGUID
+		binary.Write(&buf, binary.BigEndian, uint16(len(a.credID)))
+		buf.Write(a.credID)
+		coseKey, err := webauthncbor.Marshal(map[int]interface{}{
+			1:  2,  // kty: EC2
+			3:  -7, // alg: ES256
+			-1: 1,  // crv: P-256
+			-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+			-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+		})
+		if err != nil {
+			a.t.Fatal(err)
+		}
+		buf.Write(coseKey)
+	}
+	return buf.Bytes()
+}
+
+// create answers a registration ceremony
+func (a *softwareAuthenticator) create(session *webauthn.SessionData) *http.Request {
+	a.userHandle = session.UserID
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(true),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return a.request(map[string]interface{}{
+		"id":    b64(a.credID),
+		"rawId": b64(a.credID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64(a.clientData("webauthn.create", session.Challenge)),
+			"attestationObject": b64(attestation),
+			"transports":        []string{"internal"},
+		},
+	})
+}
+
+// get answers a login ceremony, bumping the sign count first
+func (a *softwareAuthenticator) get(session *webauthn.SessionData) *http.Request {
+	a.signCount++
+	return a.assert(session)
+}
+
+// assert signs an assertion with the current sign count
+func (a *softwareAuthenticator) assert(session *webauthn.SessionData) *http.Request {
+	authData := a.authData(false)
+	clientData := a.clientData("webauthn.get", session.Challenge)
+	clientHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return a.request(map[string]interface{}{
+		"id":    b64(a.credID),
+		"rawId": b64(a.credID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64(clientData),
+			"authenticatorData": b64(authData),
+			"signature":         b64(signature),
+			"userHandle":        b64(a.userHandle),
+		},
+	})
+}
+
+func (a *softwareAuthenticator) request(body interface{}) *http.Request {
+	data, err := json.Marshal(body)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func setupTestPasskeys(t *testing.T) {
+	t.Helper()
+	wa, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: "Auth Chat",
+		RPID:          testRPID,
+		RPOrigins:     []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	passkeys = wa
+}
+
+// registerTestPasskey runs a registration ceremony and returns the credential
+// as it would be stored
+func registerTestPasskey(t *testing.T, auth *softwareAuthenticator, user *User) *passkeyUser {
+	t.Helper()
+	pkUser := &passkeyUser{user: user}
+	_, session, err := passkeys.BeginRegistration(pkUser,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential, err := passkeys.FinishRegistration(pkUser, *session, auth.create(session))
+	if err != nil {
+		t.Fatalf("registration failed: %v", err)
+	}
+	pkUser.credentials = []PasskeyCredential{{
+		CredentialID:    b64(credential.ID),
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+	}}
+	return pkUser
+}
+
+func discoverableLogin(t *testing.T, pkUser *passkeyUser, answer func(*webauthn.SessionData) *http.Request) (*webauthn.Credential, error) {
+	t.Helper()
+	_, session, err := passkeys.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return passkeys.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		if !bytes.Equal(userHandle, pkUser.WebAuthnID()) {
+			t.Fatalf("unexpected user handle %q", userHandle)
+		}
+		return pkUser, nil
+	}, *session, answer(session))
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	setupTestPasskeys(t)
+	auth := newSoftwareAuthenticator(t)
+	pkUser := registerTestPasskey(t, auth, &User{Username: "alice", PasskeyHandle: "handle-alice"})
+
+	if got := pkUser.credentials[0].CredentialID; got != b64(auth.credID) {
+		t.Fatalf("stored credential ID = %q, want %q", got, b64(auth.credID))
+	}
+
+	credential, err := discoverableLogin(t, pkUser, auth.get)
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if credential.Authenticator.CloneWarning {
+		t.Fatal("unexpected clone warning")
+	}
+	if credential.Authenticator.SignCount != 1 {
+		t.Fatalf("sign count = %d, want 1", credential.Authenticator.SignCount)
+	}
+}
+
+func TestPasskeyLoginFlagsReplayedSignCount(t *testing.T) {
+	setupTestPasskeys(t)
+	auth := newSoftwareAuthenticator(t)
+	pkUser := registerTestPasskey(t, auth, &User{Username: "bob", PasskeyHandle: "handle-bob"})
+
+	credential, err := discoverableLogin(t, pkUser, auth.get)
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	pkUser.credentials[0].SignCount = credential.Authenticator.SignCount
+
+	// Same sign count again, as a cloned authenticator would send
+	credential, err = discoverableLogin(t, pkUser, auth.assert)
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if !credential.Authenticator.CloneWarning {
+		t.Fatal("expected a clone warning for a sign count that did not increase")
+	}
+}
+
+func TestPasskeyLoginRejectsWrongKey(t *testing.T) {
+	setupTestPasskeys(t)
+	auth := newSoftwareAuthenticator(t)
+	pkUser := registerTestPasskey(t, auth, &User{Username: "carol", PasskeyHandle: "handle-carol"})
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.key = other
+	if _, err := discoverableLogin(t, pkUser, auth.get); err == nil {
+		t.Fatal("login with a different key succeeded")
+	}
+}
+
+func TestPasskeyLoginAllowed(t *testing.T) {
+	check := func(user *User) int {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/", nil), rec)
+		if ok, _ := passkeyLoginAllowed(c, nil, user); ok {
+			return http.StatusOK
+		}
+		return rec.Code
+	}
+
+	saved := unverifiedPolicy
+	defer func() { unverifiedPolicy = saved }()
+
+	unverifiedPolicy.CanLogin = false
+	if code := check(&User{Email: "unverified@example.com"}); code != http.StatusForbidden {
+		t.Fatalf("unverified user got %d, want 403", code)
+	}
+	if code := check(&User{Email: "verified@example.com", EmailVerified: true}); code != http.StatusOK {
+		t.Fatalf("verified user got %d, want 200", code)
+	}
+
+	locked := &User{Email: "locked@example.com", EmailVerified: true}
+	defer accountGuard.Reset(accountGuardKey(locked.Email))
+	for i := 0; i < accountGuardConfig.LockoutAfter; i++ {
+		accountGuard.Fail(accountGuardKey(locked.Email), time.Now())
+	}
+	if code := check(locked); code != http.StatusTooManyRequests {
+		t.Fatalf("locked user got %d, want 429", code)
+	}
+}
+
+// finishTestPasskeyLogin runs the login handler with the authenticator's
+// answer to a fresh ceremony
+func finishTestPasskeyLogin(t *testing.T, db *gorm.DB, answer func(*webauthn.SessionData) *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	_, session, err := passkeys.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ceremonyID, err := ceremonies.put(0, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := answer(session)
+	req.URL.RawQuery = "ceremony_id=" + ceremonyID
+	rec := httptest.NewRecorder()
+	if err := finishPasskeyLoginHandler(echo.New().NewContext(req, rec), db); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestFinishPasskeyLoginHandler(t *testing.T) {
+	setupTestPasskeys(t)
+	db := newTestDB(t)
+	setupTestAchievements(t, db)
+
+	user := &User{Username: "dave", Email: "dave@example.com", EmailVerified: true, PasskeyHandle: "handle-dave"}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		accountGuard.Reset(accountGuardKey(user.Email))
+		ipGuard.Reset("192.0.2.1")
+	})
+	auth := newSoftwareAuthenticator(t)
+	stored := registerTestPasskey(t, auth, user).credentials[0]
+	stored.UserID = user.ID
+	if err := db.Create(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	rec := finishTestPasskeyLogin(t, db, auth.get)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login = %d %s, want 200", rec.Code, rec.Body)
+	}
+	var credential PasskeyCredential
+	db.First(&credential, stored.ID)
+	if credential.SignCount != 1 || credential.LastUsedAt == nil {
+		t.Fatalf("credential after login = sign count %d, last used %v", credential.SignCount, credential.LastUsedAt)
+	}
+	var sessions int64
+	db.Model(&Session{}).Where("user_id = ?", user.ID).Count(&sessions)
+	if sessions != 1 {
+		t.Fatalf("sessions after login = %d, want 1", sessions)
+	}
+
+	// A cloned authenticator replays the sign count it already used
+	rec = finishTestPasskeyLogin(t, db, auth.assert)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("login with a replayed sign count = %d, want 401", rec.Code)
+	}
+	db.First(&credential, stored.ID)
+	if credential.SignCount != 1 {
+		t.Fatalf("rejected login changed the sign count to %d", credential.SignCount)
+	}
+	db.Model(&Session{}).Where("user_id = ?", user.ID).Count(&sessions)
+	if sessions != 1 {
+		t.Fatalf("rejected login created a session, %d sessions", sessions)
+	}
+
+	if rec = finishTestPasskeyLogin(t, db, auth.get); rec.Code != http.StatusOK {
+		t.Fatalf("login after the rejected one = %d, want 200", rec.Code)
+	}
+	db.First(&credential, stored.ID)
+	if credential.SignCount != 2 {
+		t.Fatalf("sign count after second login = %d, want 2", credential.SignCount)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUnknownHash = errors.New("unknown password hash format")
+	ErrHasherBusy  = errors.New("password hasher is busy")
+)
+
+// PasswordHasher hashes passwords into a self describing encoded string, the
+// parameters used are stored in the hash so they can be changed later
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// NeedsRehash reports whether encoded was made with other parameters or
+	// another algorithm than this hasher would use now
+	NeedsRehash(encoded string) bool
+}
+
+// bcryptHasher produces standard $2a$ hashes
+type bcryptHasher struct {
+	cost int
+}
+
+func NewBcryptHasher(cost int) PasswordHasher {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		cost = bcrypt.DefaultCost
+	}
+	return &bcryptHasher{cost: cost}
+}
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(bytes), err
+}
+
+func (h *bcryptHasher) NeedsRehash(encoded string) bool {
+	if !isBcryptHash(encoded) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.cost
+}
+
+// Argon2Params are the argon2id parameters, Memory is in KiB
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// argon2idHasher produces PHC formatted hashes such as
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+type argon2idHasher struct {
+	params Argon2Params
+}
+
+func NewArgon2idHasher(params Argon2Params) PasswordHasher {
+	return &argon2idHasher{params: params}
+}
+
+func (h *argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	p := h.params
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Memory != h.params.Memory ||
+		params.Iterations != h.params.Iterations ||
+		params.Parallelism != h.params.Parallelism ||
+		uint32(len(salt)) != h.params.SaltLength ||
+		uint32(len(key)) != h.params.KeyLength
+}
+
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// verifyEncodedPassword checks password against a hash made by any of the
+// supported algorithms, whatever the currently configured hasher is
+func verifyEncodedPassword(password, encoded string) (bool, error) {
+	switch {
+	case isBcryptHash(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	default:
+		return false, ErrUnknownHash
+	}
+}
+
+// hashPool bounds how many hashes are computed at once so a burst of logins
+// or room joins can't take every CPU
+type hashPool struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newHashPool(workers int, timeout time.Duration) *hashPool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &hashPool{
+		slots:   make(chan struct{}, workers),
+		timeout: timeout,
+	}
+}
+
+// do runs fn once a slot is free, giving up with ErrHasherBusy after the
+// pool timeout
+func (p *hashPool) do(fn func()) error {
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-timer.C:
+		return ErrHasherBusy
+	}
+	defer func() { <-p.slots }()
+
+	fn()
+	return nil
+}
+
+var (
+	passwordHasher = NewBcryptHasher(12)
+	passwordPool   = newHashPool(runtime.NumCPU(), 5*time.Second)
+)
+
+// NewPasswordHasherFromEnv picks the hasher from PASSWORD_HASHER (bcrypt or
+// argon2id) and its parameters from BCRYPT_COST and the ARGON2_* variables.
+// Argon2 parameters out of range are an error rather than a panic at the
+// first login
+func NewPasswordHasherFromEnv() (PasswordHasher, error) {
+	switch os.Getenv("PASSWORD_HASHER") {
+	case "argon2id":
+		memory := envInt("ARGON2_MEMORY_KB", 64*1024)
+		iterations := envInt("ARGON2_ITERATIONS", 3)
+		parallelism := envInt("ARGON2_PARALLELISM", 2)
+		if parallelism < 1 || parallelism > math.MaxUint8 {
+			return nil, fmt.Errorf("ARGON2_PARALLELISM must be between 1 and %d, got %d", math.MaxUint8, parallelism)
+		}
+		if iterations < 1 || int64(iterations) > math.MaxUint32 {
+			return nil, fmt.Errorf("ARGON2_ITERATIONS must be between 1 and %d, got %d", uint32(math.MaxUint32), iterations)
+		}
+		// argon2 needs at least 8 KiB per lane
+		if memory < 8*parallelism || int64(memory) > math.MaxUint32 {
+			return nil, fmt.Errorf("ARGON2_MEMORY_KB must be between %d and %d, got %d", 8*parallelism, uint32(math.MaxUint32), memory)
+		}
+		return NewArgon2idHasher(Argon2Params{
+			Memory:      uint32(memory),
+			Iterations:  uint32(iterations),
+			Parallelism: uint8(parallelism),
+			SaltLength:  16,
+			KeyLength:   32,
+		}), nil
+	default:
+		return NewBcryptHasher(envInt("BCRYPT_COST", 12)), nil
+	}
+}
+
+func envInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
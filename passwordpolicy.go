@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// FieldError is a validation error for a single form field
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicy describes which passwords are accepted at registration and
+// password reset
+type PasswordPolicy struct {
+	MinLength   int
+	MaxLength   int
+	MinScore    int // 0 to 4, see passwordScore
+	BannedWords []string
+}
+
+var passwordPolicy = PasswordPolicy{
+	MinLength: 8,
+	MaxLength: 128,
+	MinScore:  2,
+}
+
+// breachChecker is nil when no breached password corpus is configured
+var breachChecker BreachedPasswordChecker
+
+func LoadPasswordPolicy() PasswordPolicy {
+	policy := passwordPolicy
+	policy.MinLength = envInt("PASSWORD_MIN_LENGTH", policy.MinLength)
+	policy.MaxLength = envInt("PASSWORD_MAX_LENGTH", policy.MaxLength)
+	policy.MinScore = envInt("PASSWORD_MIN_SCORE", policy.MinScore)
+	for _, word := range strings.Split(os.Getenv("PASSWORD_BANNED_WORDS"), ",") {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			policy.BannedWords = append(policy.BannedWords, word)
+		}
+	}
+	return policy
+}
+
+// Validate checks password against the policy. username and email are banned
+// inside the password too
+func (p PasswordPolicy) Validate(password, username, email string) []FieldError {
+	var errs []FieldError
+	add := func(code, message string) {
+		errs = append(errs, FieldError{Field: "password", Code: code, Message: message})
+	}
+
+	length := len([]rune(password))
+	if length < p.MinLength {
+		add("too_short", "Password must be at least "+strconv.Itoa(p.MinLength)+" characters")
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		add("too_long", "Password must be at most "+strconv.Itoa(p.MaxLength)+" characters")
+	}
+
+	lower := strings.ToLower(password)
+	userInputs := userInputWords(username, email)
+	for _, word := range userInputs {
+		if strings.Contains(lower, word) {
+			add("contains_user_info", "Password must not contain your username or email")
+			break
+		}
+	}
+	for _, word := range p.BannedWords {
+		if strings.Contains(lower, word) {
+			add("banned_word", "Password contains a word that is not allowed")
+			break
+		}
+	}
+
+	if len(errs) == 0 && passwordScore(password, append(userInputs, p.BannedWords...)) < p.MinScore {
+		add("too_weak", "Password is too easy to guess, try a longer passphrase")
+	}
+
+	if len(errs) == 0 && breachChecker != nil {
+		if breached, err := breachChecker.IsBreached(password); err == nil && breached {
+			add("breached", "This password has appeared in a data breach, please pick another one")
+		}
+	}
+
+	return errs
+}
+
+// userInputWords returns the parts of the username and email that are long
+// enough to be worth banning
+func userInputWords(username, email string) []string {
+	var words []string
+	add := func(w string) {
+		if w = strings.ToLower(w); len(w) >= 3 {
+			words = append(words, w)
+		}
+	}
+	add(username)
+	if local, domain, ok := strings.Cut(email, "@"); ok {
+		add(local)
+		add(strings.Split(domain, ".")[0])
+	}
+	return words
+}
+
+func validateUsername(username string) []FieldError {
+	if len(username) < 3 || len(username) > 32 {
+		return []FieldError{{Field: "username", Code: "invalid_length", Message: "Username must be between 3 and 32 characters"}}
+	}
+	for _, r := range username {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' && r != '.' {
+			return []FieldError{{Field: "username", Code: "invalid_characters", Message: "Username may only contain letters, numbers, dots, dashes and underscores"}}
+		}
+	}
+	return nil
+}
+
+func validateEmail(email string) []FieldError {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return []FieldError{{Field: "email", Code: "invalid", Message: "Email address is not valid"}}
+	}
+	return nil
+}
+
+// commonPasswordWords are matched as single tokens when scoring
+var commonPasswordWords = []string{
+	"password", "passw0rd", "qwerty", "letmein", "welcome", "admin", "login",
+	"dragon", "monkey", "football", "baseball", "master", "shadow", "sunshine",
+	"princess", "iloveyou", "trustno1", "superman", "batman", "starwars",
+	"hello", "freedom", "whatever", "secret", "azerty", "asdf", "zxcv",
+	"bitcoin", "crypto", "moon", "hodl", "love", "chat", "summer", "winter",
+}
+
+// passwordScore estimates how hard a password is to guess and returns a score
+// from 0 (trivial) to 4 (strong) on the same scale as zxcvbn. The password is
+// split greedily into dictionary words, sequences, repeats and single
+// characters and the guesses for each part are multiplied
+func passwordScore(password string, userInputs []string) int {
+	lower := []rune(strings.ToLower(password))
+	runes := []rune(password)
+	charset := charsetSize(password)
+
+	var log10Guesses float64
+	for i := 0; i < len(runes); {
+		if n := matchWord(lower[i:], userInputs); n > 0 {
+			// User inputs are the first thing an attacker tries
+			log10Guesses += 1
+			i += n
+			continue
+		}
+		if n := matchWord(lower[i:], commonPasswordWords); n > 0 {
+			log10Guesses += math.Log10(float64(len(commonPasswordWords))) + 1
+			i += n
+			continue
+		}
+		if n := matchRun(lower[i:]); n >= 3 {
+			log10Guesses += math.Log10(float64(charset) * float64(n))
+			i += n
+			continue
+		}
+		log10Guesses += math.Log10(float64(charset))
+		i++
+	}
+
+	switch {
+	case log10Guesses < 3:
+		return 0
+	case log10Guesses < 6:
+		return 1
+	case log10Guesses < 8:
+		return 2
+	case log10Guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func matchWord(s []rune, words []string) int {
+	best := 0
+	for _, word := range words {
+		w := []rune(word)
+		if len(w) >= 3 && len(w) > best && len(s) >= len(w) && string(s[:len(w)]) == word {
+			best = len(w)
+		}
+	}
+	return best
+}
+
+// matchRun returns the length of the repeat ("aaaa") or sequence ("abcd",
+// "4321") at the start of s
+func matchRun(s []rune) int {
+	if len(s) < 2 {
+		return len(s)
+	}
+	delta := s[1] - s[0]
+	if delta < -1 || delta > 1 {
+		return 1
+	}
+	n := 2
+	for n < len(s) && s[n]-s[n-1] == delta {
+		n++
+	}
+	return n
+}
+
+func charsetSize(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	size := 0
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if other {
+		size += 33
+	}
+	if size == 0 {
+		size = 1
+	}
+	return size
+}
+
+// BreachedPasswordChecker reports whether a password is known to be breached
+type BreachedPasswordChecker interface {
+	IsBreached(password string) (bool, error)
+}
+
+// BreachRangeSource returns the SHA-1 suffixes known for a 5 character hash
+// prefix, the same k-anonymity model as the Have I Been Pwned range API
+type BreachRangeSource interface {
+	Range(prefix string) ([]string, error)
+}
+
+// kAnonymityChecker only ever hands the first 5 hex characters of the hash to
+// its source, so the source never learns the password
+type kAnonymityChecker struct {
+	source BreachRangeSource
+}
+
+func NewKAnonymityChecker(source BreachRangeSource) BreachedPasswordChecker {
+	return &kAnonymityChecker{source: source}
+}
+
+func (k *kAnonymityChecker) IsBreached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes, err := k.source.Range(hash[:5])
+	if err != nil {
+		return false, err
+	}
+	for _, suffix := range suffixes {
+		if suffix == hash[5:] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// NewFileRangeSource serves ranges from a local copy of the HIBP corpus
+// without loading it into memory. path is either a directory with one
+// "PREFIX.txt" file per 5 character prefix holding "SUFFIX:COUNT" lines, as
+// written by the HIBP downloader, or a single file of "SHA1HASH:COUNT" lines
+// ordered by hash, which is searched with a binary search
+func NewFileRangeSource(path string) BreachRangeSource {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return &dirRangeSource{dir: path}
+	}
+	return &sortedFileRangeSource{path: path}
+}
+
+var hashPrefixPattern = regexp.MustCompile(`^[0-9A-F]{5}$`)
+
+// dirRangeSource reads the file of a prefix on every lookup
+type dirRangeSource struct {
+	dir string
+}
+
+func (d *dirRangeSource) Range(prefix string) ([]string, error) {
+	prefix = strings.ToUpper(prefix)
+	if !hashPrefixPattern.MatchString(prefix) {
+		return nil, fmt.Errorf("invalid hash prefix %q", prefix)
+	}
+	file, err := os.Open(filepath.Join(d.dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var suffixes []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		switch len(hash) {
+		case 35:
+			suffixes = append(suffixes, strings.ToUpper(hash))
+		case 40:
+			suffixes = append(suffixes, strings.ToUpper(hash[5:]))
+		}
+	}
+	return suffixes, scanner.Err()
+}
+
+// sortedFileRangeSource binary searches a file ordered by hash. The file is
+// opened once, lookups only read the lines around the prefix
+type sortedFileRangeSource struct {
+	path string
+
+	once sync.Once
+	file *os.File
+	size int64
+	err  error
+}
+
+func (s *sortedFileRangeSource) open() {
+	s.file, s.err = os.Open(s.path)
+	if s.err != nil {
+		return
+	}
+	info, err := s.file.Stat()
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.size = info.Size()
+}
+
+// lineAfter returns the offset and hash of the first line starting at or
+// after off. At the end of the file the hash is empty
+func (s *sortedFileRangeSource) lineAfter(off int64) (int64, string, error) {
+	start := off
+	if off > 0 {
+		// Back up one byte so a line starting exactly at off is found
+		reader := bufio.NewReader(io.NewSectionReader(s.file, off-1, s.size-off+1))
+		skipped, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return s.size, "", nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		start = off - 1 + int64(len(skipped))
+	}
+	if start >= s.size {
+		return s.size, "", nil
+	}
+	line, err := bufio.NewReader(io.NewSectionReader(s.file, start, s.size-start)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	hash, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+	return start, strings.ToUpper(hash), nil
+}
+
+func (s *sortedFileRangeSource) Range(prefix string) ([]string, error) {
+	s.once.Do(s.open)
+	if s.err != nil {
+		return nil, s.err
+	}
+	prefix = strings.ToUpper(prefix)
+
+	// Smallest offset whose next line sorts at or after the prefix
+	lo, hi := int64(0), s.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, hash, err := s.lineAfter(mid)
+		if err != nil {
+			return nil, err
+		}
+		if start >= s.size || hash >= prefix {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	start, _, err := s.lineAfter(lo)
+	if err != nil {
+		return nil, err
+	}
+
+	var suffixes []string
+	scanner := bufio.NewScanner(io.NewSectionReader(s.file, start, s.size-start))
+	for scanner.Scan() {
+		hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		hash = strings.ToUpper(hash)
+		if len(hash) != 40 {
+			continue
+		}
+		if !strings.HasPrefix(hash, prefix) {
+			break
+		}
+		suffixes = append(suffixes, hash[5:])
+	}
+	return suffixes, scanner.Err()
+}
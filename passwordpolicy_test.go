@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPasswordScore(t *testing.T) {
+	tests := []struct {
+		password   string
+		userInputs []string
+		want       int
+	}{
+		{"", nil, 0},
+		{"password", nil, 0},
+		{"aaaaaaaa", nil, 0},
+		{"abcdefgh", nil, 0},
+		{"87654321", nil, 0},
+		{"qwerty123", nil, 1},
+		{"xk9#", nil, 2},
+		{"alice2024", nil, 4},
+		{"alice2024", []string{"alice"}, 2},
+		{"Tr0ub4dor&3", nil, 4},
+		{"correct horse battery staple", nil, 4},
+	}
+	for _, tt := range tests {
+		if got := passwordScore(tt.password, tt.userInputs); got != tt.want {
+			t.Errorf("passwordScore(%q, %v) = %d, want %d", tt.password, tt.userInputs, got, tt.want)
+		}
+	}
+}
+
+func TestMatchRun(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"a", 1},
+		{"ab", 2},
+		{"az", 1},
+		{"aaab", 3},
+		{"abcdx", 4},
+		{"4321", 4},
+		{"13579", 1},
+	}
+	for _, tt := range tests {
+		if got := matchRun([]rune(tt.s)); got != tt.want {
+			t.Errorf("matchRun(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestCharsetSize(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"", 1},
+		{"abc", 26},
+		{"ABC", 26},
+		{"123", 10},
+		{"aB1", 62},
+		{"aB1!", 95},
+		{"é!", 59},
+	}
+	for _, tt := range tests {
+		if got := charsetSize(tt.password); got != tt.want {
+			t.Errorf("charsetSize(%q) = %d, want %d", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, MaxLength: 20, MinScore: 2, BannedWords: []string{"chatapp"}}
+	tests := []struct {
+		password string
+		want     []string
+	}{
+		{"short", []string{"too_short"}},
+		{strings.Repeat("x9#", 10), []string{"too_long"}},
+		{"alice-likes-tea", []string{"contains_user_info"}},
+		{"my chatapp pass", []string{"banned_word"}},
+		{"password123", []string{"too_weak"}},
+		{"plum violin 47 kite", nil},
+	}
+	for _, tt := range tests {
+		var codes []string
+		for _, e := range policy.Validate(tt.password, "alice", "alice@example.com") {
+			codes = append(codes, e.Code)
+		}
+		if !reflect.DeepEqual(codes, tt.want) {
+			t.Errorf("Validate(%q) = %v, want %v", tt.password, codes, tt.want)
+		}
+	}
+}
+
+// writeBreachFile writes lines of "SHA1:COUNT" and returns the path
+func writeBreachFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSortedFileRangeSource(t *testing.T) {
+	hashes := []string{
+		"0000011111111111111111111111111111111111",
+		"0000022222222222222222222222222222222222",
+		"1234500000000000000000000000000000000000",
+		"12346AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+		"ABCDE00000000000000000000000000000000001",
+		"ABCDEFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF",
+		"FFFFF00000000000000000000000000000000000",
+	}
+	var lines []string
+	for i, hash := range hashes {
+		lines = append(lines, hash+":"+strings.Repeat("9", i+1))
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"00000", []string{hashes[0][5:], hashes[1][5:]}},
+		{"12345", []string{hashes[2][5:]}},
+		{"12346", []string{hashes[3][5:]}},
+		{"abcde", []string{hashes[4][5:], hashes[5][5:]}},
+		{"FFFFF", []string{hashes[6][5:]}},
+		{"00001", nil},
+		{"77777", nil},
+		{"FFFFE", nil},
+	}
+
+	files := map[string]string{
+		"trailing newline":    strings.Join(lines, "\n") + "\n",
+		"no trailing newline": strings.Join(lines, "\n"),
+		"CRLF":                strings.Join(lines, "\r\n") + "\r\n",
+	}
+	for name, content := range files {
+		source := NewFileRangeSource(writeBreachFile(t, content))
+		for _, tt := range tests {
+			got, err := source.Range(tt.prefix)
+			if err != nil {
+				t.Fatalf("%s: Range(%q) failed: %v", name, tt.prefix, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: Range(%q) = %v, want %v", name, tt.prefix, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestSortedFileRangeSourceSingleLine(t *testing.T) {
+	hash := "ABCDE00000000000000000000000000000000001"
+	source := NewFileRangeSource(writeBreachFile(t, hash+":3"))
+	if got, err := source.Range("ABCDE"); err != nil || len(got) != 1 || got[0] != hash[5:] {
+		t.Fatalf("Range(ABCDE) = %v, %v", got, err)
+	}
+	for _, prefix := range []string{"00000", "FFFFF"} {
+		if got, err := source.Range(prefix); err != nil || got != nil {
+			t.Fatalf("Range(%s) = %v, %v", prefix, got, err)
+		}
+	}
+
+	empty := NewFileRangeSource(writeBreachFile(t, ""))
+	if got, err := empty.Range("ABCDE"); err != nil || got != nil {
+		t.Fatalf("empty file: Range(ABCDE) = %v, %v", got, err)
+	}
+}
+
+func TestDirRangeSource(t *testing.T) {
+	dir := t.TempDir()
+	content := "0000000000000000000000000000000000A:5\r\n" + "0000000000000000000000000000000000B:1"
+	if err := os.WriteFile(filepath.Join(dir, "ABCDE.txt"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	source := NewFileRangeSource(dir)
+
+	got, err := source.Range("abcde")
+	want := []string{"0000000000000000000000000000000000A", "0000000000000000000000000000000000B"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Range(abcde) = %v, %v, want %v", got, err, want)
+	}
+	if got, err := source.Range("12345"); err != nil || got != nil {
+		t.Fatalf("missing prefix file: Range(12345) = %v, %v", got, err)
+	}
+	if _, err := source.Range("../x"); err == nil {
+		t.Fatal("Range accepted a prefix that isn't hex")
+	}
+}
+
+func TestKAnonymityChecker(t *testing.T) {
+	sum := sha1.Sum([]byte("hunter2"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	source := NewFileRangeSource(writeBreachFile(t, hash+":17\n"))
+	checker := NewKAnonymityChecker(source)
+
+	if breached, err := checker.IsBreached("hunter2"); err != nil || !breached {
+		t.Fatalf("IsBreached(hunter2) = %v, %v, want true", breached, err)
+	}
+	if breached, err := checker.IsBreached("hunter3"); err != nil || breached {
+		t.Fatalf("IsBreached(hunter3) = %v, %v, want false", breached, err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Global roles, stored on User.Role
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// Room roles, stored on RoomParticipant.Role. Users that aren't participants
+// of a room are guests there, except in password protected and private rooms
+// where they have no role at all
+const (
+	RoomRoleOwner     = "owner"
+	RoomRoleModerator = "moderator"
+	RoomRoleMember    = "member"
+	RoomRoleGuest     = "guest"
+	RoomRoleNone      = ""
+)
+
+// Permission is something a user can be allowed to do in a room
+type Permission string
+
+const (
+	PermRoomRead        Permission = "room:read"
+	PermRoomSend        Permission = "room:send"
+	PermRoomModerate    Permission = "room:moderate"
+	PermRoomManage      Permission = "room:manage"
+	PermRoomManageRoles Permission = "room:manage_roles"
+	PermRoomDelete      Permission = "room:delete"
+	PermRoomTransfer    Permission = "room:transfer"
+)
+
+var roomRolePermissions = map[string][]Permission{
+	RoomRoleOwner: {
+		PermRoomRead, PermRoomSend, PermRoomModerate, PermRoomManage,
+		PermRoomManageRoles, PermRoomDelete, PermRoomTransfer,
+	},
+	RoomRoleModerator: {PermRoomRead, PermRoomSend, PermRoomModerate},
+	RoomRoleMember:    {PermRoomRead, PermRoomSend},
+	RoomRoleGuest:     {PermRoomRead, PermRoomSend},
+}
+
+// roomRoleRank orders room roles so moderators can't act on owners and so on
+var roomRoleRank = map[string]int{
+	RoomRoleGuest:     0,
+	RoomRoleMember:    1,
+	RoomRoleModerator: 2,
+	RoomRoleOwner:     3,
+}
+
+func validRoomRole(role string) bool {
+	_, ok := roomRolePermissions[role]
+	return ok
+}
+
+// RoleHasPermission reports whether role grants perm
+func RoleHasPermission(role string, perm Permission) bool {
+	for _, p := range roomRolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// RoomRoleOf returns the role user has in room. user may be nil for guests.
+// Global admins act as owners of every room
+func RoomRoleOf(db *gorm.DB, user *User, room *ChatRoom) string {
+	if user == nil {
+		return outsiderRole(room)
+	}
+	if user.IsAdmin() || room.OwnerID == user.ID {
+		return RoomRoleOwner
+	}
+
+	var participant RoomParticipant
+	if err := db.Where("room_id = ? AND user_id = ?", room.ID, user.ID).First(&participant).Error; err != nil {
+		return outsiderRole(room)
+	}
+	if !validRoomRole(participant.Role) {
+		return RoomRoleMember
+	}
+	return participant.Role
+}
+
+// outsiderRole is the role of users that aren't participants of room. The
+// password of a room only keeps people out if they get no permissions
+// without it
+func outsiderRole(room *ChatRoom) string {
+	if room.HasPassword || room.Visibility == RoomVisibilityPrivate {
+		return RoomRoleNone
+	}
+	return RoomRoleGuest
+}
+
+// CanInRoom is the single permission check for room actions, both the REST
+// middleware and the hub go through it
+func CanInRoom(db *gorm.DB, user *User, room *ChatRoom, perm Permission) bool {
+	return RoleHasPermission(RoomRoleOf(db, user, room), perm)
+}
+
+// CanViewRoom reports whether user may see that room exists. Private rooms
+// are hidden from everyone but their participants, whatever their role.
+// user may be nil for guests
+func CanViewRoom(db *gorm.DB, user *User, room *ChatRoom) bool {
+	if room.Visibility != RoomVisibilityPrivate {
+		return true
+	}
+	return isRoomParticipant(db, user, room)
+}
+
+// isRoomParticipant reports whether user has a participant row in room. The
+// owner and global admins always count as participants
+func isRoomParticipant(db *gorm.DB, user *User, room *ChatRoom) bool {
+	if user == nil {
+		return false
+	}
+	if user.IsAdmin() || room.OwnerID == user.ID {
+		return true
+	}
+	var count int64
+	db.Model(&RoomParticipant{}).Where("room_id = ? AND user_id = ?", room.ID, user.ID).Count(&count)
+	return count > 0
+}
+
+// optionalUser returns the authenticated user of the request, or nil for guests
+func optionalUser(c echo.Context, db *gorm.DB) *User {
+	if GetUsername(c) == "" {
+		if err := Authorize(c, db); err != nil {
+			return nil
+		}
+	}
+	var user User
+	if err := db.Where("username = ?", GetUsername(c)).First(&user).Error; err != nil {
+		return nil
+	}
+	return &user
+}
+
+// RequireGlobalRole only lets users with role through. It expects the request
+// to be authorized already
+func RequireGlobalRole(db *gorm.DB, role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var user User
+			if err := db.Where("username = ?", GetUsername(c)).First(&user).Error; err != nil || user.Role != role {
+				return c.JSON(http.StatusForbidden, map[string]string{
+					"error": "Forbidden",
+				})
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireRoomPermission authorizes the request and checks perm in the room
+// named by the :roomID param. The loaded user and room are stored in the
+// context as "user" and "room" for the handler
+func RequireRoomPermission(db *gorm.DB, perm Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if GetUsername(c) == "" {
+				if err := Authorize(c, db); err != nil {
+					return c.JSON(http.StatusUnauthorized, map[string]string{
+						"error": "Unauthorized",
+					})
+				}
+			}
+
+			var user User
+			if err := db.Where("username = ?", GetUsername(c)).First(&user).Error; err != nil {
+				return c.JSON(http.StatusNotFound, map[string]string{
+					"error": "User not found",
+				})
+			}
+
+			var room ChatRoom
+			if err := db.Where("room_id = ?", c.Param("roomID")).First(&room).Error; err != nil {
+				return c.JSON(http.StatusNotFound, map[string]string{
+					"error": "Room not found",
+				})
+			}
+
+			// Outsiders of a private room get the same answer as for a room
+			// that doesn't exist
+			if !CanViewRoom(db, &user, &room) {
+				return c.JSON(http.StatusNotFound, map[string]string{
+					"error": "Room not found",
+				})
+			}
+
+			if !CanInRoom(db, &user, &room, perm) {
+				return c.JSON(http.StatusForbidden, map[string]string{
+					"error": "You don't have permission to do that in this room",
+				})
+			}
+
+			c.Set("user", &user)
+			c.Set("room", &room)
+			return next(c)
+		}
+	}
+}
+
+// contextUserAndRoom returns what RequireRoomPermission stored in the context
+func contextUserAndRoom(c echo.Context) (*User, *ChatRoom) {
+	user, _ := c.Get("user").(*User)
+	room, _ := c.Get("room").(*ChatRoom)
+	return user, room
+}
+
+// setMemberRoleHandler changes the room role of a participant. Owners can
+// promote members to moderators and back, ownership itself can't be given
+// away here
+func setMemberRoleHandler(c echo.Context, db *gorm.DB, hub *Hub) error {
+	actor, room := contextUserAndRoom(c)
+
+	role := c.FormValue("role")
+	if role != RoomRoleModerator && role != RoomRoleMember && role != RoomRoleGuest {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Role must be moderator, member or guest",
+		})
+	}
+
+	var target User
+	if err := db.Where("username = ?", c.Param("username")).First(&target).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	if target.ID == room.OwnerID {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "The owner's role can't be changed",
+		})
+	}
+	if !outranks(db, room, actor, &target) {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "You can't change the role of this user",
+		})
+	}
+
+	// Look the participant up first, MySQL reports no affected rows when the
+	// role is unchanged
+	var participant RoomParticipant
+	if err := db.Where("room_id = ? AND user_id = ?", room.ID, target.ID).First(&participant).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User is not a participant of this room",
+		})
+	}
+
+	if err := db.Model(&RoomParticipant{}).
+		Where("room_id = ? AND user_id = ?", room.ID, target.ID).
+		Update("role", role).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to update role",
+		})
+	}
+
+	hub.roomEvents <- &RoomEvent{Kind: RoomEventRole, UserID: target.ID, RoomID: room.RoomID, Role: role}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message":  "Role updated",
+		"username": target.Username,
+		"role":     role,
+	})
+}
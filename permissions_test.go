@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRequireRoomPermission(t *testing.T) {
+	db := newTestDB(t)
+	owner := createTestUser(t, db, "alice")
+	member := createTestUser(t, db, "bob")
+	outsider := createTestUser(t, db, "carol")
+
+	private := &ChatRoom{Name: "secret", RoomID: "secret", OwnerID: owner.ID, Visibility: RoomVisibilityPrivate}
+	public := &ChatRoom{Name: "lobby", RoomID: "lobby", OwnerID: owner.ID, Visibility: RoomVisibilityPublic}
+	for _, room := range []*ChatRoom{private, public} {
+		if err := db.Create(room).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Create(&RoomParticipant{RoomID: room.ID, UserID: member.ID, Role: RoomRoleMember, JoinedAt: time.Now()}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	call := func(user *User, roomID string, perm Permission) int {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/", nil), rec)
+		c.Set("username", user.Username)
+		c.SetParamNames("roomID")
+		c.SetParamValues(roomID)
+		handler := RequireRoomPermission(db, perm)(func(c echo.Context) error {
+			if _, room := contextUserAndRoom(c); room == nil || room.RoomID != roomID {
+				t.Fatalf("room in context = %+v", room)
+			}
+			return c.NoContent(http.StatusOK)
+		})
+		if err := handler(c); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code
+	}
+
+	tests := []struct {
+		name   string
+		user   *User
+		roomID string
+		perm   Permission
+		want   int
+	}{
+		{"owner manages private room", owner, "secret", PermRoomManage, http.StatusOK},
+		{"member reads private room", member, "secret", PermRoomRead, http.StatusOK},
+		{"member can't manage private room", member, "secret", PermRoomManage, http.StatusForbidden},
+		{"outsider can't see private room", outsider, "secret", PermRoomRead, http.StatusNotFound},
+		{"outsider can't see private room to moderate", outsider, "secret", PermRoomModerate, http.StatusNotFound},
+		{"outsider reads public room", outsider, "lobby", PermRoomRead, http.StatusOK},
+		{"outsider can't moderate public room", outsider, "lobby", PermRoomModerate, http.StatusForbidden},
+		{"missing room", owner, "nope", PermRoomRead, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if got := call(tt.user, tt.roomID, tt.perm); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
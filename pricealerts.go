@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Alert directions, "crosses" is resolved to one of them when the alert is
+// created
+const (
+	AlertAbove   = "above"
+	AlertBelow   = "below"
+	AlertCrosses = "crosses"
+)
+
+// Alert modes
+const (
+	// Fires once, then is deleted after it was delivered
+	AlertModeOnce = "once"
+	// Fires every time the price crosses the target, re-arming once it is
+	// back on the other side
+	AlertModeRecurring = "recurring"
+)
+
+var ErrAlertLimit = errors.New("too many active alerts")
+
+// maxPriceAlerts is the number of active or undelivered alerts a user can
+// have, set with PRICE_ALERTS_PER_USER
+var maxPriceAlerts = 20
+
+// PriceAlert notifies a user when a coin goes above or below a price
+type PriceAlert struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	UserID       uint       `gorm:"index" json:"-"`
+	Symbol       string     `gorm:"size:10;index:idx_price_alerts_symbol_active" json:"symbol"`
+	Direction    string     `gorm:"size:8" json:"direction"`
+	Target       float64    `json:"target"`
+	Mode         string     `gorm:"size:16" json:"mode"`
+	Active       bool       `gorm:"index:idx_price_alerts_symbol_active" json:"active"`
+	Armed        bool       `json:"armed"`
+	TriggerCount int        `json:"trigger_count"`
+	TriggeredAt  *time.Time `json:"triggered_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+
+	// Set when the alert fired and the user hasn't been shown it yet, it is
+	// delivered on the next login or connection
+	Pending         bool    `gorm:"index" json:"pending"`
+	TriggeredPrice  float64 `json:"triggered_price,omitempty"`
+	TriggeredChange float64 `json:"-"`
+}
+
+func (a *PriceAlert) describe() string {
+	text := fmt.Sprintf("$%s %s %s", a.Symbol, a.Direction, strconv.FormatFloat(a.Target, 'f', -1, 64))
+	if a.Mode == AlertModeRecurring {
+		text += ", recurring"
+	}
+	return text
+}
+
+// createPriceAlert validates and stores an alert. direction may be "crosses",
+// which needs a cached price to tell which side the target is on
+func createPriceAlert(db *gorm.DB, user *User, symbol, direction string, target float64, mode string) (*PriceAlert, error) {
+	coin, ok := coinRegistry.Lookup(symbol)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown coin %s", ErrInvalidInput, symbol)
+	}
+	if target <= 0 {
+		return nil, fmt.Errorf("%w: the price must be positive", ErrInvalidInput)
+	}
+	if mode == "" {
+		mode = AlertModeOnce
+	}
+	if mode != AlertModeOnce && mode != AlertModeRecurring {
+		return nil, fmt.Errorf("%w: mode must be once or recurring", ErrInvalidInput)
+	}
+
+	switch direction {
+	case AlertAbove, AlertBelow:
+	case AlertCrosses:
+		var current CoinPrice
+		if prices != nil {
+			current, ok = prices.Get(coin.Symbol)
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: no price for $%s yet, use above or below", ErrInvalidInput, coin.Symbol)
+		}
+		direction = AlertAbove
+		if current.Price > target {
+			direction = AlertBelow
+		}
+	default:
+		return nil, fmt.Errorf("%w: direction must be above, below or crosses", ErrInvalidInput)
+	}
+
+	alert := &PriceAlert{
+		UserID:    user.ID,
+		Symbol:    coin.Symbol,
+		Direction: direction,
+		Target:    target,
+		Mode:      mode,
+		Active:    true,
+		Armed:     true,
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&PriceAlert{}).Where("user_id = ? AND (active = ? OR pending = ?)", user.ID, true, true).Count(&count).Error; err != nil {
+			return err
+		}
+		if count >= int64(maxPriceAlerts) {
+			return ErrAlertLimit
+		}
+		return tx.Create(alert).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return alert, nil
+}
+
+func listPriceAlerts(db *gorm.DB, user *User) ([]PriceAlert, error) {
+	alerts := []PriceAlert{}
+	err := db.Where("user_id = ? AND active = ?", user.ID, true).Order("id").Find(&alerts).Error
+	return alerts, err
+}
+
+// deletePriceAlert removes an alert of user, it reports false if there was none
+func deletePriceAlert(db *gorm.DB, user *User, id uint) (bool, error) {
+	result := db.Where("id = ? AND user_id = ?", id, user.ID).Delete(&PriceAlert{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// priceAlertUpdates feeds changed prices to the evaluator. It is buffered so
+// the price service never waits, a dropped update is caught up by the next
+var priceAlertUpdates = make(chan []CoinPrice, 16)
+
+func queuePriceAlertUpdate(changed []CoinPrice) {
+	select {
+	case priceAlertUpdates <- changed:
+	default:
+	}
+}
+
+// runPriceAlertEvaluator checks the alerts of every coin whose price changed
+func runPriceAlertEvaluator(db *gorm.DB, hub *Hub, updates <-chan []CoinPrice) {
+	for changed := range updates {
+		for _, price := range changed {
+			if err := evaluatePriceAlerts(db, hub, price); err != nil {
+				slog.Error("failed to evaluate price alerts", "symbol", price.Symbol, "error", err)
+			}
+		}
+	}
+}
+
+func evaluatePriceAlerts(db *gorm.DB, hub *Hub, price CoinPrice) error {
+	// Recurring alerts re-arm once the price is back on the other side
+	if err := db.Model(&PriceAlert{}).
+		Where("symbol = ? AND active = ? AND armed = ? AND mode = ?", price.Symbol, true, false, AlertModeRecurring).
+		Where("((direction = ? AND target > ?) OR (direction = ? AND target < ?))", AlertAbove, price.Price, AlertBelow, price.Price).
+		Update("armed", true).Error; err != nil {
+		return err
+	}
+
+	var triggered []PriceAlert
+	if err := db.Where("symbol = ? AND active = ? AND armed = ?", price.Symbol, true, true).
+		Where("((direction = ? AND target <= ?) OR (direction = ? AND target >= ?))", AlertAbove, price.Price, AlertBelow, price.Price).
+		Find(&triggered).Error; err != nil {
+		return err
+	}
+
+	// Rounded to what the triggered_at column stores, so delivery can match on it
+	now := time.Now().Truncate(time.Millisecond)
+	for i := range triggered {
+		alert := &triggered[i]
+		updates := map[string]interface{}{
+			"armed":            false,
+			"trigger_count":    gorm.Expr("trigger_count + 1"),
+			"triggered_at":     now,
+			"pending":          true,
+			"triggered_price":  price.Price,
+			"triggered_change": price.Change24h,
+		}
+		if alert.Mode == AlertModeOnce {
+			updates["active"] = false
+		}
+		if err := db.Model(alert).Updates(updates).Error; err != nil {
+			return err
+		}
+		alert.TriggeredAt = &now
+		notifyPriceAlert(db, hub, alert, price)
+	}
+	return nil
+}
+
+func priceAlertMessage(alert *PriceAlert, price CoinPrice) ChatMessage {
+	return ChatMessage{
+		Type:    MessageTypePriceAlert,
+		Content: fmt.Sprintf("Price alert: %s (%s)", formatPrice(price), alert.describe()),
+		Price:   &price,
+	}
+}
+
+// notifyPriceAlert sends a triggered alert to every client of its user. If
+// no client got it the alert stays pending and is delivered on the next login
+// or connection
+func notifyPriceAlert(db *gorm.DB, hub *Hub, alert *PriceAlert, price CoinPrice) {
+	delivered := *alert
+	hub.notify <- &Notification{
+		UserID:  alert.UserID,
+		Message: priceAlertMessage(alert, price),
+		Delivered: func(clients int) {
+			if clients > 0 {
+				go markPriceAlertsDelivered(db, delivered)
+			}
+		},
+	}
+}
+
+func pendingPriceAlerts(db *gorm.DB, userID uint) ([]PriceAlert, error) {
+	pending := []PriceAlert{}
+	err := db.Where("user_id = ? AND pending = ?", userID, true).Order("triggered_at").Find(&pending).Error
+	return pending, err
+}
+
+// markPriceAlertsDelivered clears the pending flag of alerts. Alerts that
+// only fire once are done then and get deleted. A recurring alert that fired
+// again since it was sent keeps its newer trigger pending
+func markPriceAlertsDelivered(db *gorm.DB, alerts ...PriceAlert) {
+	var once []uint
+	for _, alert := range alerts {
+		if alert.Mode == AlertModeOnce {
+			once = append(once, alert.ID)
+			continue
+		}
+		if err := db.Model(&PriceAlert{}).Where("id = ? AND triggered_at = ?", alert.ID, alert.TriggeredAt).
+			Update("pending", false).Error; err != nil {
+			slog.Error("failed to mark price alert delivered", "alert", alert.ID, "error", err)
+		}
+	}
+	if len(once) > 0 {
+		if err := db.Where("id IN ? AND pending = ?", once, true).Delete(&PriceAlert{}).Error; err != nil {
+			slog.Error("failed to delete delivered price alerts", "error", err)
+		}
+	}
+}
+
+// pruneFiredPriceAlerts is a one-time migration that deletes the once alerts
+// which fired and were delivered while delivered alerts were still kept
+func pruneFiredPriceAlerts(db *gorm.DB) {
+	if err := db.Where("mode = ? AND active = ? AND pending = ?", AlertModeOnce, false, false).Delete(&PriceAlert{}).Error; err != nil {
+		slog.Error("failed to prune fired price alerts", "error", err)
+	}
+}
+
+// deliverPendingPriceAlerts sends a newly connected client the alerts that
+// fired while its user was offline
+func deliverPendingPriceAlerts(db *gorm.DB, hub *Hub, client *Client) {
+	pending, err := pendingPriceAlerts(db, client.user.ID)
+	if err != nil {
+		return
+	}
+	for i := range pending {
+		alert := pending[i]
+		price := CoinPrice{Symbol: alert.Symbol, Price: alert.TriggeredPrice, Change24h: alert.TriggeredChange}
+		if alert.TriggeredAt != nil {
+			price.UpdatedAt = *alert.TriggeredAt
+		}
+		hub.notify <- &Notification{
+			Client:  client,
+			Message: priceAlertMessage(&alert, price),
+			Delivered: func(clients int) {
+				if clients > 0 {
+					go markPriceAlertsDelivered(db, alert)
+				}
+			},
+		}
+	}
+}
+
+func createPriceAlertHandler(c echo.Context, db *gorm.DB) error {
+	var user User
+	if err := db.Where("username = ?", GetUsername(c)).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	target, err := strconv.ParseFloat(c.FormValue("price"), 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "price must be a number",
+		})
+	}
+
+	alert, err := createPriceAlert(db, &user, c.FormValue("symbol"), c.FormValue("direction"), target, c.FormValue("mode"))
+	if err != nil {
+		return priceAlertErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusCreated, alert)
+}
+
+func listPriceAlertsHandler(c echo.Context, db *gorm.DB) error {
+	var user User
+	if err := db.Where("username = ?", GetUsername(c)).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	alerts, err := listPriceAlerts(db, &user)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch alerts",
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"alerts": alerts,
+		"limit":  maxPriceAlerts,
+	})
+}
+
+func deletePriceAlertHandler(c echo.Context, db *gorm.DB) error {
+	var user User
+	if err := db.Where("username = ?", GetUsername(c)).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Alert not found",
+		})
+	}
+	deleted, err := deletePriceAlert(db, &user, uint(id))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to delete alert",
+		})
+	}
+	if !deleted {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Alert not found",
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Alert deleted",
+	})
+}
+
+func priceAlertErrorResponse(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, ErrInvalidInput):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": strings.TrimPrefix(err.Error(), ErrInvalidInput.Error()+": "),
+		})
+	case errors.Is(err, ErrAlertLimit):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("You can have up to %d alerts", maxPriceAlerts),
+		})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"error": "Failed to create alert",
+	})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// newAlertHub returns a hub whose notifications queue up for the test to read
+func newAlertHub(db *gorm.DB) *Hub {
+	h := newHub(db)
+	h.notify = make(chan *Notification, 16)
+	return h
+}
+
+func notifications(h *Hub) []*Notification {
+	var sent []*Notification
+	for {
+		select {
+		case n := <-h.notify:
+			sent = append(sent, n)
+		default:
+			return sent
+		}
+	}
+}
+
+func storeAlert(t *testing.T, db *gorm.DB, user *User, direction string, target float64, mode string) *PriceAlert {
+	t.Helper()
+	alert := &PriceAlert{UserID: user.ID, Symbol: "BTC", Direction: direction, Target: target, Mode: mode, Active: true, Armed: true}
+	if err := db.Create(alert).Error; err != nil {
+		t.Fatal(err)
+	}
+	return alert
+}
+
+func loadAlert(t *testing.T, db *gorm.DB, id uint) (PriceAlert, bool) {
+	t.Helper()
+	var alert PriceAlert
+	err := db.First(&alert, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return alert, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alert, true
+}
+
+// evaluate runs the evaluator for a BTC price and returns the notifications
+func evaluate(t *testing.T, db *gorm.DB, h *Hub, price float64) []*Notification {
+	t.Helper()
+	if err := evaluatePriceAlerts(db, h, CoinPrice{Symbol: "BTC", Price: price, Change24h: 1}); err != nil {
+		t.Fatal(err)
+	}
+	return notifications(h)
+}
+
+// waitForAlert polls until the alert matches, delivery marks alerts in a goroutine
+func waitForAlert(t *testing.T, db *gorm.DB, id uint, done func(PriceAlert, bool) bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if done(loadAlert(t, db, id)) {
+			return
+		}
+	}
+	alert, found := loadAlert(t, db, id)
+	t.Fatalf("alert %d = %+v (found %v) after delivery", id, alert, found)
+}
+
+func TestEvaluatePriceAlerts(t *testing.T) {
+	db := newTestDB(t)
+	h := newAlertHub(db)
+	user := createTestUser(t, db, "alice")
+	above := storeAlert(t, db, user, AlertAbove, 100, AlertModeOnce)
+	below := storeAlert(t, db, user, AlertBelow, 50, AlertModeOnce)
+	farAbove := storeAlert(t, db, user, AlertAbove, 200, AlertModeOnce)
+
+	sent := evaluate(t, db, h, 150)
+	if len(sent) != 1 || sent[0].UserID != user.ID || sent[0].Message.Type != MessageTypePriceAlert {
+		t.Fatalf("notifications = %+v, want one price alert for the user", sent)
+	}
+	fired, _ := loadAlert(t, db, above.ID)
+	if fired.Active || fired.Armed || !fired.Pending || fired.TriggerCount != 1 || fired.TriggeredPrice != 150 || fired.TriggeredAt == nil {
+		t.Fatalf("fired alert = %+v", fired)
+	}
+	for _, id := range []uint{below.ID, farAbove.ID} {
+		if alert, _ := loadAlert(t, db, id); !alert.Active || !alert.Armed || alert.Pending {
+			t.Fatalf("alert %d fired at 150: %+v", id, alert)
+		}
+	}
+
+	// Nobody was online, the alert stays pending and doesn't fire again
+	sent[0].Delivered(0)
+	if sent := evaluate(t, db, h, 160); len(sent) != 0 {
+		t.Fatalf("fired alert notified again: %+v", sent)
+	}
+	if pending, err := pendingPriceAlerts(db, user.ID); err != nil || len(pending) != 1 || pending[0].ID != above.ID {
+		t.Fatalf("pendingPriceAlerts = %+v, %v", pending, err)
+	}
+
+	// Once delivered an alert that only fires once is deleted
+	sent = evaluate(t, db, h, 40)
+	if len(sent) != 1 {
+		t.Fatalf("below alert sent %d notifications, want 1", len(sent))
+	}
+	sent[0].Delivered(1)
+	waitForAlert(t, db, below.ID, func(_ PriceAlert, found bool) bool { return !found })
+}
+
+func TestEvaluatePriceAlertsRecurring(t *testing.T) {
+	db := newTestDB(t)
+	h := newAlertHub(db)
+	user := createTestUser(t, db, "alice")
+	alert := storeAlert(t, db, user, AlertAbove, 100, AlertModeRecurring)
+
+	sent := evaluate(t, db, h, 150)
+	if len(sent) != 1 {
+		t.Fatalf("first crossing sent %d notifications, want 1", len(sent))
+	}
+	sent[0].Delivered(1)
+	waitForAlert(t, db, alert.ID, func(a PriceAlert, _ bool) bool { return !a.Pending })
+
+	if sent := evaluate(t, db, h, 160); len(sent) != 0 {
+		t.Fatalf("alert fired again before re-arming: %+v", sent)
+	}
+	if sent := evaluate(t, db, h, 90); len(sent) != 0 {
+		t.Fatalf("re-arming sent %+v", sent)
+	}
+	if got, _ := loadAlert(t, db, alert.ID); !got.Armed || !got.Active {
+		t.Fatalf("alert after dropping below the target = %+v, want armed", got)
+	}
+
+	if sent = evaluate(t, db, h, 110); len(sent) != 1 {
+		t.Fatalf("second crossing sent %d notifications, want 1", len(sent))
+	}
+	got, found := loadAlert(t, db, alert.ID)
+	if !found || !got.Active || got.Armed || !got.Pending || got.TriggerCount != 2 || got.TriggeredPrice != 110 {
+		t.Fatalf("alert after second crossing = %+v", got)
+	}
+	sent[0].Delivered(1)
+	waitForAlert(t, db, alert.ID, func(a PriceAlert, found bool) bool { return found && !a.Pending })
+}
+
+func TestMarkPriceAlertsDeliveredKeepsNewerTrigger(t *testing.T) {
+	db := newTestDB(t)
+	h := newAlertHub(db)
+	user := createTestUser(t, db, "alice")
+	alert := storeAlert(t, db, user, AlertAbove, 100, AlertModeRecurring)
+
+	first := evaluate(t, db, h, 150)
+	time.Sleep(2 * time.Millisecond)
+	evaluate(t, db, h, 90)
+	second := evaluate(t, db, h, 150)
+	if len(first) != 1 || len(second) != 1 {
+		t.Fatalf("notifications = %d and %d, want one each", len(first), len(second))
+	}
+
+	// The first notification reaches a client after the alert fired again
+	first[0].Delivered(1)
+	time.Sleep(50 * time.Millisecond)
+	if got, _ := loadAlert(t, db, alert.ID); !got.Pending {
+		t.Fatal("delivering the first trigger cleared the pending second one")
+	}
+
+	second[0].Delivered(1)
+	waitForAlert(t, db, alert.ID, func(a PriceAlert, _ bool) bool { return !a.Pending })
+}
+
+func TestCreatePriceAlertLimit(t *testing.T) {
+	db := newTestDB(t)
+	h := newAlertHub(db)
+	user := createTestUser(t, db, "alice")
+	other := createTestUser(t, db, "bob")
+
+	registry, err := loadCoinRegistry("coins.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedRegistry, savedMax := coinRegistry, maxPriceAlerts
+	coinRegistry, maxPriceAlerts = registry, 2
+	t.Cleanup(func() { coinRegistry, maxPriceAlerts = savedRegistry, savedMax })
+
+	fired, err := createPriceAlert(db, user, "BTC", AlertAbove, 100, AlertModeOnce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createPriceAlert(db, user, "BTC", AlertBelow, 50, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createPriceAlert(db, user, "BTC", AlertAbove, 300, AlertModeOnce); !errors.Is(err, ErrAlertLimit) {
+		t.Fatalf("third alert: err = %v, want ErrAlertLimit", err)
+	}
+	if _, err := createPriceAlert(db, other, "BTC", AlertAbove, 300, AlertModeOnce); err != nil {
+		t.Fatalf("other user's alert counted against the limit: %v", err)
+	}
+
+	// A fired alert counts until it is delivered
+	sent := evaluate(t, db, h, 150)
+	if len(sent) != 1 || sent[0].UserID != user.ID {
+		t.Fatalf("notifications = %+v, want one for the user", sent)
+	}
+	if _, err := createPriceAlert(db, user, "BTC", AlertAbove, 300, AlertModeOnce); !errors.Is(err, ErrAlertLimit) {
+		t.Fatalf("alert while one is pending: err = %v, want ErrAlertLimit", err)
+	}
+	sent[0].Delivered(1)
+	waitForAlert(t, db, fired.ID, func(_ PriceAlert, found bool) bool { return !found })
+	if _, err := createPriceAlert(db, user, "BTC", AlertAbove, 300, AlertModeOnce); err != nil {
+		t.Fatalf("alert after delivery: %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CoinPrice is the USD price of a coin
+type CoinPrice struct {
+	Symbol    string    `json:"symbol"`
+	Price     float64   `json:"price"`
+	Change24h float64   `json:"change_24h"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PriceProvider fetches the current prices of coins. Coins the provider has
+// no price for are left out of the result
+type PriceProvider interface {
+	Prices(ctx context.Context, coins []Coin) (map[string]CoinPrice, error)
+}
+
+// httpPriceProvider reads prices from a CoinGecko compatible simple price
+// API, coins are requested by their registry ID
+type httpPriceProvider struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewHTTPPriceProvider(baseURL string) PriceProvider {
+	return &httpPriceProvider{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *httpPriceProvider) Prices(ctx context.Context, coins []Coin) (map[string]CoinPrice, error) {
+	bySymbol := map[string]string{}
+	ids := make([]string, 0, len(coins))
+	for _, coin := range coins {
+		if coin.ID == "" {
+			continue
+		}
+		bySymbol[coin.ID] = coin.Symbol
+		ids = append(ids, coin.ID)
+	}
+	if len(ids) == 0 {
+		return map[string]CoinPrice{}, nil
+	}
+
+	query := url.Values{
+		"ids":                 {strings.Join(ids, ",")},
+		"vs_currencies":       {"usd"},
+		"include_24hr_change": {"true"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.baseURL+"/simple/price?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("price API returned %s", resp.Status)
+	}
+
+	var body map[string]struct {
+		USD       float64 `json:"usd"`
+		Change24h float64 `json:"usd_24h_change"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode price API response: %w", err)
+	}
+
+	now := time.Now()
+	prices := make(map[string]CoinPrice, len(body))
+	for id, quote := range body {
+		symbol, ok := bySymbol[id]
+		if !ok || quote.USD <= 0 {
+			continue
+		}
+		prices[symbol] = CoinPrice{Symbol: symbol, Price: quote.USD, Change24h: quote.Change24h, UpdatedAt: now}
+	}
+	return prices, nil
+}
+
+// replayPriceProvider plays back prices from a file, one frame per call and
+// starting over after the last one. The file is a JSON array of frames
+// mapping symbols to prices, e.g. [{"BTC": 65000, "ETH": 3200}, ...]. The 24h
+// change is relative to the first frame that has the coin
+type replayPriceProvider struct {
+	frames []map[string]float64
+	first  map[string]float64
+
+	mu   sync.Mutex
+	next int
+}
+
+func NewReplayPriceProvider(path string) (PriceProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var frames []map[string]float64
+	if err := json.Unmarshal(data, &frames); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("%s: no price frames", path)
+	}
+
+	first := map[string]float64{}
+	for i, frame := range frames {
+		normalized := make(map[string]float64, len(frame))
+		for symbol, price := range frame {
+			symbol = strings.ToUpper(symbol)
+			normalized[symbol] = price
+			if _, ok := first[symbol]; !ok {
+				first[symbol] = price
+			}
+		}
+		frames[i] = normalized
+	}
+	return &replayPriceProvider{frames: frames, first: first}, nil
+}
+
+func (p *replayPriceProvider) Prices(ctx context.Context, coins []Coin) (map[string]CoinPrice, error) {
+	p.mu.Lock()
+	frame := p.frames[p.next]
+	p.next = (p.next + 1) % len(p.frames)
+	p.mu.Unlock()
+
+	now := time.Now()
+	prices := map[string]CoinPrice{}
+	for _, coin := range coins {
+		price, ok := frame[coin.Symbol]
+		if !ok {
+			continue
+		}
+		var change float64
+		if first := p.first[coin.Symbol]; first != 0 {
+			change = (price - first) / first * 100
+		}
+		prices[coin.Symbol] = CoinPrice{Symbol: coin.Symbol, Price: price, Change24h: change, UpdatedAt: now}
+	}
+	return prices, nil
+}
+
+// PriceService polls a provider and caches the latest price of every
+// registered coin
+type PriceService interface {
+	// Get returns the cached price of a coin
+	Get(symbol string) (CoinPrice, bool)
+	// Poll fetches new prices, Run calls it periodically
+	Poll(ctx context.Context) error
+	Run(interval time.Duration)
+	// OnUpdate registers a callback for prices that changed in a poll
+	OnUpdate(fn func(changed []CoinPrice))
+}
+
+type priceService struct {
+	provider PriceProvider
+	coins    []Coin
+
+	mu       sync.RWMutex
+	cache    map[string]CoinPrice
+	onUpdate []func([]CoinPrice)
+}
+
+func NewPriceService(provider PriceProvider, coins []Coin) PriceService {
+	return &priceService{
+		provider: provider,
+		coins:    coins,
+		cache:    make(map[string]CoinPrice),
+	}
+}
+
+func (s *priceService) Get(symbol string) (CoinPrice, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	price, ok := s.cache[strings.ToUpper(strings.TrimPrefix(symbol, "$"))]
+	return price, ok
+}
+
+func (s *priceService) OnUpdate(fn func([]CoinPrice)) {
+	s.mu.Lock()
+	s.onUpdate = append(s.onUpdate, fn)
+	s.mu.Unlock()
+}
+
+// Poll keeps the previous prices when the provider fails, they carry their
+// own UpdatedAt so clients can tell they're stale
+func (s *priceService) Poll(ctx context.Context) error {
+	prices, err := s.provider.Prices(ctx, s.coins)
+	if err != nil {
+		return err
+	}
+
+	var changed []CoinPrice
+	s.mu.Lock()
+	for symbol, price := range prices {
+		if old, ok := s.cache[symbol]; !ok || old.Price != price.Price {
+			changed = append(changed, price)
+		}
+		s.cache[symbol] = price
+	}
+	callbacks := s.onUpdate
+	s.mu.Unlock()
+
+	if len(changed) > 0 {
+		for _, fn := range callbacks {
+			fn(changed)
+		}
+	}
+	return nil
+}
+
+func (s *priceService) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := s.Poll(ctx); err != nil {
+			slog.Error("failed to poll coin prices", "error", err)
+		}
+		cancel()
+		<-ticker.C
+	}
+}
+
+var prices PriceService
+
+// newPriceProviderFromEnv picks the provider set by PRICE_PROVIDER, "http"
+// (the default) or "replay" which reads PRICE_REPLAY_FILE
+func newPriceProviderFromEnv() (PriceProvider, error) {
+	switch os.Getenv("PRICE_PROVIDER") {
+	case "", "http":
+		baseURL := os.Getenv("PRICE_API_URL")
+		if baseURL == "" {
+			baseURL = "https://api.coingecko.com/api/v3"
+		}
+		return NewHTTPPriceProvider(baseURL), nil
+	case "replay":
+		path := os.Getenv("PRICE_REPLAY_FILE")
+		if path == "" {
+			return nil, errors.New("PRICE_REPLAY_FILE is required for the replay price provider")
+		}
+		return NewReplayPriceProvider(path)
+	}
+	return nil, fmt.Errorf("unknown PRICE_PROVIDER %q", os.Getenv("PRICE_PROVIDER"))
+}
+
+// formatPrice renders a price like "$BTC $65,012.34 (+1.25% 24h)"
+func formatPrice(price CoinPrice) string {
+	decimals := 2
+	if price.Price < 1 {
+		decimals = 6
+	}
+	text := strconv.FormatFloat(price.Price, 'f', decimals, 64)
+	whole, frac, _ := strings.Cut(text, ".")
+	var grouped strings.Builder
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			grouped.WriteByte(',')
+		}
+		grouped.WriteRune(digit)
+	}
+	return fmt.Sprintf("$%s $%s.%s (%+.2f%% 24h)", price.Symbol, grouped.String(), frac, price.Change24h)
+}
+
+// priceMessage is the ticker event pushed to a room
+func priceMessage(roomID string, price CoinPrice) ChatMessage {
+	return ChatMessage{
+		Type:    MessageTypePrice,
+		Content: formatPrice(price),
+		RoomID:  roomID,
+		Price:   &price,
+	}
+}
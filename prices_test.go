@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+var testCoins = []Coin{
+	{Symbol: "BTC", Name: "Bitcoin", ID: "bitcoin"},
+	{Symbol: "ETH", Name: "Ethereum", ID: "ethereum"},
+	{Symbol: "SOL", Name: "Solana", ID: "solana"},
+	{Symbol: "DOGE", Name: "Dogecoin", ID: "dogecoin"},
+}
+
+// pollChanged polls once and returns the symbols reported as changed
+func pollChanged(t *testing.T, service PriceService, updates *[][]CoinPrice) []string {
+	t.Helper()
+	*updates = nil
+	if err := service.Poll(context.Background()); err != nil {
+		t.Fatalf("poll failed: %v", err)
+	}
+	var symbols []string
+	for _, changed := range *updates {
+		for _, price := range changed {
+			symbols = append(symbols, price.Symbol)
+		}
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+func TestPricePollReplay(t *testing.T) {
+	provider, err := NewReplayPriceProvider("prices.replay.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := NewPriceService(provider, testCoins)
+	var updates [][]CoinPrice
+	service.OnUpdate(func(changed []CoinPrice) { updates = append(updates, changed) })
+
+	all := []string{"BTC", "DOGE", "ETH", "SOL"}
+	if got := pollChanged(t, service, &updates); len(got) != 4 {
+		t.Fatalf("first poll changed %v, want %v", got, all)
+	}
+	btc, ok := service.Get("$btc")
+	if !ok || btc.Price != 65000 || btc.Change24h != 0 {
+		t.Fatalf("BTC after first frame = %+v, %v", btc, ok)
+	}
+
+	if got := pollChanged(t, service, &updates); len(got) != 4 {
+		t.Fatalf("second poll changed %v, want %v", got, all)
+	}
+	btc, _ = service.Get("BTC")
+	if btc.Price != 65250.5 {
+		t.Fatalf("BTC after second frame = %v, want 65250.5", btc.Price)
+	}
+	if want := (65250.5 - 65000) / 65000 * 100; btc.Change24h != want {
+		t.Fatalf("BTC change = %v, want %v", btc.Change24h, want)
+	}
+
+	// The replay starts over after the last frame
+	pollChanged(t, service, &updates)
+	pollChanged(t, service, &updates)
+	pollChanged(t, service, &updates)
+	if btc, _ = service.Get("BTC"); btc.Price != 65000 {
+		t.Fatalf("BTC after wrapping = %v, want 65000", btc.Price)
+	}
+}
+
+func TestPricePollOnlyReportsChangedPrices(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.json")
+	frames := `[{"BTC": 100, "eth": 10}, {"BTC": 100, "ETH": 11}, {"BTC": 100, "ETH": 11}]`
+	if err := os.WriteFile(path, []byte(frames), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewReplayPriceProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := NewPriceService(provider, testCoins)
+	var updates [][]CoinPrice
+	service.OnUpdate(func(changed []CoinPrice) { updates = append(updates, changed) })
+
+	if got := pollChanged(t, service, &updates); len(got) != 2 {
+		t.Fatalf("first poll changed %v, want BTC and ETH", got)
+	}
+	if got := pollChanged(t, service, &updates); len(got) != 1 || got[0] != "ETH" {
+		t.Fatalf("second poll changed %v, want ETH", got)
+	}
+	pollChanged(t, service, &updates)
+	if len(updates) != 0 {
+		t.Fatalf("poll without changes called OnUpdate with %v", updates)
+	}
+	if _, ok := service.Get("SOL"); ok {
+		t.Fatal("SOL has a price but is missing from every frame")
+	}
+}
+
+func TestFormatPrice(t *testing.T) {
+	tests := []struct {
+		price CoinPrice
+		want  string
+	}{
+		{CoinPrice{Symbol: "BTC", Price: 65012.34, Change24h: 1.25}, "$BTC $65,012.34 (+1.25% 24h)"},
+		{CoinPrice{Symbol: "BTC", Price: 1234567.891, Change24h: -0.5}, "$BTC $1,234,567.89 (-0.50% 24h)"},
+		{CoinPrice{Symbol: "ETH", Price: 999.999, Change24h: 0}, "$ETH $1,000.00 (+0.00% 24h)"},
+		{CoinPrice{Symbol: "SOL", Price: 150, Change24h: 12.345}, "$SOL $150.00 (+12.35% 24h)"},
+		{CoinPrice{Symbol: "DOGE", Price: 0.1495, Change24h: -0.333}, "$DOGE $0.149500 (-0.33% 24h)"},
+	}
+	for _, tt := range tests {
+		if got := formatPrice(tt.price); got != tt.want {
+			t.Errorf("formatPrice(%v) = %q, want %q", tt.price.Price, got, tt.want)
+		}
+	}
+}
+
+// testRoomClient adds a client with a buffered send channel to a hub room
+func testRoomClient(h *Hub, roomID string) *Client {
+	client := &Client{hub: h, send: make(chan ChatMessage, 8), currentRoom: roomID}
+	h.clients[client] = true
+	if h.rooms[roomID] == nil {
+		h.rooms[roomID] = make(map[*Client]bool)
+	}
+	h.rooms[roomID][client] = true
+	return client
+}
+
+func received(client *Client) []ChatMessage {
+	var messages []ChatMessage
+	for {
+		select {
+		case m := <-client.send:
+			messages = append(messages, m)
+		default:
+			return messages
+		}
+	}
+}
+
+func TestHandlePricesFanOut(t *testing.T) {
+	h := newHub(nil)
+	coinRoom := testRoomClient(h, coinRoomID("BTC"))
+	recent := testRoomClient(h, "recent")
+	stale := testRoomClient(h, "stale")
+	other := testRoomClient(h, "other")
+
+	now := time.Now()
+	h.recentCoins["BTC"] = map[string]time.Time{
+		"recent":          now.Add(-time.Minute),
+		"stale":           now.Add(-priceEventWindow - time.Minute),
+		coinRoomID("BTC"): now,
+	}
+	h.recentCoins["ETH"] = map[string]time.Time{"other": now}
+
+	btc := CoinPrice{Symbol: "BTC", Price: 65000, Change24h: 1}
+	h.handlePrices([]CoinPrice{btc})
+
+	got := received(coinRoom)
+	if len(got) != 1 || got[0].Type != MessageTypeAnnouncement || got[0].RoomID != coinRoomID("BTC") {
+		t.Fatalf("coin room got %+v, want one announcement", got)
+	}
+	if got[0].Content != formatPrice(btc) || got[0].Price == nil || got[0].Price.Price != 65000 {
+		t.Fatalf("coin room announcement = %+v", got[0])
+	}
+
+	got = received(recent)
+	if len(got) != 1 || got[0].Type != MessageTypePrice || got[0].RoomID != "recent" || got[0].Content != formatPrice(btc) {
+		t.Fatalf("recent room got %+v, want one price event", got)
+	}
+
+	if got := received(stale); len(got) != 0 {
+		t.Fatalf("stale room got %+v", got)
+	}
+	if _, ok := h.recentCoins["BTC"]["stale"]; ok {
+		t.Fatal("stale room was not forgotten")
+	}
+	if got := received(other); len(got) != 0 {
+		t.Fatalf("room that only mentioned ETH got %+v", got)
+	}
+
+	// Once every room went quiet the coin is dropped
+	h.recentCoins["BTC"] = map[string]time.Time{"recent": now.Add(-2 * priceEventWindow)}
+	h.handlePrices([]CoinPrice{btc})
+	if _, ok := h.recentCoins["BTC"]; ok {
+		t.Fatal("coin without recent rooms was not dropped")
+	}
+	if got := received(recent); len(got) != 0 {
+		t.Fatalf("quiet room got %+v", got)
+	}
+}
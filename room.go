@@ -6,15 +6,36 @@ import (
 	"gorm.io/gorm"
 )
 
+// Room visibility, stored on ChatRoom.Visibility
+const (
+	// Listed for everyone
+	RoomVisibilityPublic = "public"
+	// Not listed, reachable by room ID or invite
+	RoomVisibilityUnlisted = "unlisted"
+	// Only participants can see or join it, others need an invite
+	RoomVisibilityPrivate = "private"
+)
+
+func validRoomVisibility(visibility string) bool {
+	return visibility == RoomVisibilityPublic || visibility == RoomVisibilityUnlisted || visibility == RoomVisibilityPrivate
+}
+
 type ChatRoom struct {
 	gorm.Model
-	Name            string  `json:"name"`
-	OwnerID         uint    `json:"owner_id"`
-	Password        string  `json:"password,omitempty"`
-	HasPassword     bool    `json:"has_password"`
-	MaxParticipants int     `json:"max_participants"` // Limit of 1-10 people
-	Participants    []*User `gorm:"many2many:room_participants;" json:"participants,omitempty"`
-	RoomID          string  `json:"room_id"`
+	Name            string     `json:"name"`
+	Description     string     `gorm:"size:500" json:"description"`
+	Topic           string     `gorm:"size:200" json:"topic"`
+	OwnerID         uint       `json:"owner_id"`
+	Password        string     `json:"password,omitempty"`
+	HasPassword     bool       `json:"has_password"`
+	MaxParticipants int        `json:"max_participants"` // Limit of 1-10 people, 0 means no limit (coin rooms)
+	Participants    []*User    `gorm:"many2many:room_participants;" json:"participants,omitempty"`
+	RoomID          string     `json:"room_id"`
+	SlowModeSeconds int        `json:"slow_mode_seconds"` // 0 means off
+	ArchivedAt      *time.Time `json:"archived_at"`       // archived rooms are read-only
+	Visibility      string     `gorm:"size:16;default:public;index" json:"visibility"`
+	Kind            string     `gorm:"size:16;default:standard;index" json:"kind"`
+	CoinSymbol      string     `gorm:"size:10;index" json:"coin_symbol,omitempty"` // set on coin rooms
 }
 
 type RoomParticipant struct {
@@ -23,4 +44,6 @@ type RoomParticipant struct {
 	JoinedAt   time.Time
 	IsActive   bool // Track if user is currently in the room
 	LastActive time.Time
+	Role       string     `gorm:"size:16;default:member"` // owner, moderator, member or guest
+	MutedUntil *time.Time // nil when not muted
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultRoomPageSize = 20
+	maxRoomPageSize     = 100
+)
+
+// Room listing sort orders, all descending
+const (
+	RoomSortActivity = "activity"
+	RoomSortNewest   = "newest"
+	RoomSortMembers  = "members"
+)
+
+var roomSortColumns = map[string]string{
+	RoomSortActivity: "COALESCE(p.last_activity, chat_rooms.created_at)",
+	RoomSortNewest:   "chat_rooms.created_at",
+	RoomSortMembers:  "COALESCE(p.member_count, 0)",
+}
+
+// roomCursor is the position after the last room of a page. Only the field
+// matching Sort is set
+type roomCursor struct {
+	Sort  string     `json:"s"`
+	Time  *time.Time `json:"t,omitempty"`
+	Count int64      `json:"c,omitempty"`
+	ID    uint       `json:"id"`
+}
+
+func (rc roomCursor) encode() string {
+	data, _ := json.Marshal(rc)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeRoomCursor(s string) (roomCursor, bool) {
+	var rc roomCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(data, &rc) != nil {
+		return rc, false
+	}
+	if rc.Sort == RoomSortMembers {
+		return rc, true
+	}
+	return rc, rc.Time != nil
+}
+
+// discoveredRoom is a room listing entry with its live counts
+type discoveredRoom struct {
+	ID              uint       `json:"-"`
+	RoomID          string     `json:"room_id"`
+	Name            string     `json:"name"`
+	Description     string     `json:"description"`
+	Topic           string     `json:"topic"`
+	Tags            []string   `gorm:"-" json:"tags"`
+	OwnerID         uint       `json:"owner_id"`
+	HasPassword     bool       `json:"has_password"`
+	MaxParticipants int        `json:"max_participants"`
+	Visibility      string     `json:"visibility"`
+	Kind            string     `json:"kind"`
+	CoinSymbol      string     `json:"coin_symbol,omitempty"`
+	ArchivedAt      *time.Time `json:"archived_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	MemberCount     int64      `json:"member_count"`
+	ActiveUsers     int64      `json:"active_users"`
+	LastActivity    time.Time  `json:"last_activity"`
+}
+
+// likeEscaper escapes the LIKE wildcards in user input
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// listRoomsHandler lists public rooms a page at a time. Query params:
+// q (name search), tags (comma separated, rooms must have all of them),
+// free_slots=true, password=true|false, kind=standard|coin,
+// sort=activity|newest|members, limit and cursor. Coin rooms have kind
+// "coin" and their coin_symbol set
+func listRoomsHandler(c echo.Context, db *gorm.DB) error {
+	sort := c.QueryParam("sort")
+	if sort == "" {
+		sort = RoomSortActivity
+	}
+	sortColumn, ok := roomSortColumns[sort]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "sort must be activity, newest or members",
+		})
+	}
+
+	limit := defaultRoomPageSize
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxRoomPageSize {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "limit must be between 1 and 100",
+			})
+		}
+		limit = n
+	}
+
+	// Counts for every room come from one grouped subquery instead of a
+	// query per room
+	counts := db.Table("room_participants").
+		Select("room_id, COUNT(*) AS member_count, SUM(CASE WHEN is_active THEN 1 ELSE 0 END) AS active_users, MAX(last_active) AS last_activity").
+		Group("room_id")
+
+	query := db.Table("chat_rooms").
+		Select("chat_rooms.id, chat_rooms.room_id, chat_rooms.name, chat_rooms.description, chat_rooms.topic, "+
+			"chat_rooms.owner_id, chat_rooms.has_password, "+
+			"chat_rooms.max_participants, chat_rooms.visibility, chat_rooms.kind, chat_rooms.coin_symbol, chat_rooms.archived_at, chat_rooms.created_at, "+
+			"COALESCE(p.member_count, 0) AS member_count, COALESCE(p.active_users, 0) AS active_users, "+
+			"COALESCE(p.last_activity, chat_rooms.created_at) AS last_activity").
+		Joins("LEFT JOIN (?) p ON p.room_id = chat_rooms.id", counts).
+		Where("chat_rooms.deleted_at IS NULL AND chat_rooms.visibility = ?", RoomVisibilityPublic)
+
+	if q := strings.TrimSpace(c.QueryParam("q")); q != "" {
+		query = query.Where("chat_rooms.name LIKE ?", "%"+likeEscaper.Replace(q)+"%")
+	}
+
+	if raw := c.QueryParam("tags"); raw != "" {
+		tags, err := normalizeTags(raw)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid tags, " + err.Error(),
+			})
+		}
+		if len(tags) > 0 {
+			query = query.Where("chat_rooms.id IN (?)", db.Table("room_tags").
+				Select("room_id").
+				Where("tag IN ?", tags).
+				Group("room_id").
+				Having("COUNT(DISTINCT tag) = ?", len(tags)))
+		}
+	}
+
+	if c.QueryParam("free_slots") == "true" {
+		query = query.Where("(chat_rooms.max_participants = 0 OR COALESCE(p.active_users, 0) < chat_rooms.max_participants)")
+	}
+
+	switch kind := c.QueryParam("kind"); kind {
+	case "":
+	case RoomKindStandard, RoomKindCoin:
+		query = query.Where("chat_rooms.kind = ?", kind)
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "kind must be standard or coin",
+		})
+	}
+
+	switch c.QueryParam("password") {
+	case "true":
+		query = query.Where("chat_rooms.has_password = ?", true)
+	case "false":
+		query = query.Where("chat_rooms.has_password = ?", false)
+	}
+
+	if raw := c.QueryParam("cursor"); raw != "" {
+		cursor, ok := decodeRoomCursor(raw)
+		if !ok || cursor.Sort != sort {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid cursor",
+			})
+		}
+		var value interface{} = cursor.Count
+		if sort != RoomSortMembers {
+			value = *cursor.Time
+		}
+		query = query.Where("("+sortColumn+" < ? OR ("+sortColumn+" = ? AND chat_rooms.id < ?))", value, value, cursor.ID)
+	}
+
+	var rooms []discoveredRoom
+	if err := query.Order(sortColumn + " DESC, chat_rooms.id DESC").
+		Limit(limit + 1).
+		Scan(&rooms).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch rooms",
+		})
+	}
+
+	nextCursor := ""
+	if len(rooms) > limit {
+		rooms = rooms[:limit]
+		last := rooms[limit-1]
+		cursor := roomCursor{Sort: sort, ID: last.ID}
+		switch sort {
+		case RoomSortActivity:
+			cursor.Time = &last.LastActivity
+		case RoomSortNewest:
+			cursor.Time = &last.CreatedAt
+		case RoomSortMembers:
+			cursor.Count = last.MemberCount
+		}
+		nextCursor = cursor.encode()
+	}
+
+	ids := make([]uint, 0, len(rooms))
+	for _, room := range rooms {
+		ids = append(ids, room.ID)
+	}
+	tags := roomTagNames(db, ids...)
+	for i := range rooms {
+		rooms[i].Tags = tags[rooms[i].ID]
+		if rooms[i].Tags == nil {
+			rooms[i].Tags = []string{}
+		}
+	}
+
+	if rooms == nil {
+		rooms = []discoveredRoom{}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"rooms":       rooms,
+		"next_cursor": nextCursor,
+	})
+}
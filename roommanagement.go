@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const maxRoomNameLength = 64
+
+// updateRoomHandler changes the settings of a room. Only the fields present in
+// the request are touched, clear_password=true removes the password
+func updateRoomHandler(c echo.Context, db *gorm.DB, hub *Hub) error {
+	actor, room := contextUserAndRoom(c)
+
+	if room.ArchivedAt != nil {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": "Archived rooms can't be changed, unarchive it first",
+		})
+	}
+
+	updates := make(map[string]interface{})
+	var changes []string
+
+	if name, ok := formValue(c, "name"); ok {
+		name = strings.TrimSpace(name)
+		if name == "" || len(name) > maxRoomNameLength {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Room name is required and must be at most 64 characters",
+			})
+		}
+		if name != room.Name {
+			updates["name"] = name
+			changes = append(changes, fmt.Sprintf("renamed the room to %q", name))
+		}
+	}
+
+	if maxStr, ok := formValue(c, "max_participants"); ok {
+		if room.Kind == RoomKindCoin {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Coin rooms have no participant limit",
+			})
+		}
+		max, err := strconv.Atoi(maxStr)
+		if err != nil || max < 1 || max > 10 {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "max_participants must be between 1 and 10",
+			})
+		}
+		if max != room.MaxParticipants {
+			updates["max_participants"] = max
+			changes = append(changes, fmt.Sprintf("set the room limit to %d", max))
+		}
+	}
+
+	if description, ok := formValue(c, "description"); ok {
+		description = strings.TrimSpace(description)
+		if !validRoomDescription(description) {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Description must be at most 500 characters",
+			})
+		}
+		if description != room.Description {
+			updates["description"] = description
+			changes = append(changes, "updated the room description")
+		}
+	}
+
+	var tags []string
+	raw, tagsSet := formValue(c, "tags")
+	if tagsSet {
+		var err error
+		if tags, err = normalizeTags(raw); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid tags, " + err.Error(),
+			})
+		}
+	}
+
+	if visibility, ok := formValue(c, "visibility"); ok {
+		if !validRoomVisibility(visibility) {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Visibility must be public, unlisted or private",
+			})
+		}
+		if visibility != room.Visibility {
+			updates["visibility"] = visibility
+			changes = append(changes, "made the room "+visibility)
+		}
+	}
+
+	password := c.FormValue("password")
+	clearPassword := c.FormValue("clear_password") == "true"
+	if password != "" && clearPassword {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Set either password or clear_password, not both",
+		})
+	}
+	if password != "" {
+		hashed, err := hashPassword(password)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to secure room password",
+			})
+		}
+		updates["password"] = hashed
+		updates["has_password"] = true
+		changes = append(changes, "changed the room password")
+	} else if clearPassword && room.HasPassword {
+		updates["password"] = ""
+		updates["has_password"] = false
+		changes = append(changes, "removed the room password")
+	}
+
+	if len(updates) == 0 && !tagsSet {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Nothing to update",
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if len(updates) > 0 {
+			if err := tx.Model(room).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		if tagsSet {
+			return setRoomTags(tx, room.ID, tags)
+		}
+		return nil
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to update room",
+		})
+	}
+
+	// Tag changes aren't worth interrupting the chat for
+	if len(changes) > 0 {
+		hub.roomEvents <- &RoomEvent{
+			Kind:    RoomEventUpdated,
+			RoomID:  room.RoomID,
+			Message: actor.Username + " " + strings.Join(changes, ", "),
+		}
+	}
+
+	room.Password = ""
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"room": room,
+		"tags": roomTagNames(db, room.ID)[room.ID],
+	})
+}
+
+// formValue is like c.FormValue but tells an empty value apart from a missing
+// one
+func formValue(c echo.Context, name string) (string, bool) {
+	form, err := c.FormParams()
+	if err != nil {
+		return "", false
+	}
+	values, ok := form[name]
+	if !ok || len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// deleteRoomHandler removes a room with its members, bans and tags and
+// disconnects everyone still in it. The moderation log is kept
+func deleteRoomHandler(c echo.Context, db *gorm.DB, hub *Hub) error {
+	actor, room := contextUserAndRoom(c)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("room_id = ?", room.ID).Delete(&RoomParticipant{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("room_id = ?", room.ID).Delete(&RoomBan{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("room_id = ?", room.ID).Delete(&RoomTag{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("room_id = ?", room.ID).Delete(&RoomInvite{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(room).Error
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to delete room",
+		})
+	}
+
+	hub.roomEvents <- &RoomEvent{
+		Kind:    RoomEventDeleted,
+		RoomID:  room.RoomID,
+		Message: "This room was deleted by " + actor.Username,
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Room deleted",
+	})
+}
+
+// archiveRoomHandler makes a room read-only, archived=false brings it back
+func archiveRoomHandler(c echo.Context, db *gorm.DB, hub *Hub, archived bool) error {
+	actor, room := contextUserAndRoom(c)
+
+	if (room.ArchivedAt != nil) == archived {
+		state := "not archived"
+		if archived {
+			state = "already archived"
+		}
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": "Room is " + state,
+		})
+	}
+
+	var archivedAt *time.Time
+	message := actor.Username + " unarchived the room"
+	if archived {
+		now := time.Now()
+		archivedAt = &now
+		message = actor.Username + " archived the room, it is now read-only"
+	}
+
+	if err := db.Model(room).Update("archived_at", archivedAt).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to update room",
+		})
+	}
+
+	hub.roomEvents <- &RoomEvent{
+		Kind:     RoomEventArchived,
+		RoomID:   room.RoomID,
+		Archived: archived,
+		Message:  message,
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"room_id":     room.RoomID,
+		"archived_at": archivedAt,
+	})
+}
+
+// transferRoomHandler hands the room over to another participant. The old
+// owner stays on as a moderator
+func transferRoomHandler(c echo.Context, db *gorm.DB, hub *Hub) error {
+	_, room := contextUserAndRoom(c)
+
+	var target User
+	if err := db.Where("username = ?", c.FormValue("username")).First(&target).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+	if target.ID == room.OwnerID {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "User already owns this room",
+		})
+	}
+	if activeBan(db, room.ID, target.ID) != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "User is banned from this room",
+		})
+	}
+
+	var previousOwner User
+	db.First(&previousOwner, room.OwnerID)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&RoomParticipant{}).
+			Where("room_id = ? AND user_id = ?", room.ID, target.ID).
+			Update("role", RoomRoleOwner)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotParticipant
+		}
+		if err := tx.Model(&RoomParticipant{}).
+			Where("room_id = ? AND user_id = ?", room.ID, room.OwnerID).
+			Update("role", RoomRoleModerator).Error; err != nil {
+			return err
+		}
+		return tx.Model(room).Update("owner_id", target.ID).Error
+	})
+	if errors.Is(err, ErrNotParticipant) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Ownership can only go to a participant of this room",
+		})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to transfer ownership",
+		})
+	}
+
+	// Admins keep acting as owners
+	previousRole := RoomRoleModerator
+	if previousOwner.IsAdmin() {
+		previousRole = RoomRoleOwner
+	}
+	hub.roomEvents <- &RoomEvent{Kind: RoomEventRole, RoomID: room.RoomID, UserID: previousOwner.ID, Role: previousRole}
+	hub.roomEvents <- &RoomEvent{
+		Kind:    RoomEventRole,
+		RoomID:  room.RoomID,
+		UserID:  target.ID,
+		Role:    RoomRoleOwner,
+		Message: target.Username + " is now the owner of this room",
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message":  "Ownership transferred",
+		"room_id":  room.RoomID,
+		"owner":    target.Username,
+		"previous": previousOwner.Username,
+	})
+}
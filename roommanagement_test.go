@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestDeleteRoomHandler(t *testing.T) {
+	db := newTestDB(t)
+	hub := newHub(db)
+	hub.roomEvents = make(chan *RoomEvent, 1)
+	owner := createTestUser(t, db, "alice")
+	room := &ChatRoom{Name: "lobby", RoomID: "lobby", OwnerID: owner.ID}
+	if err := db.Create(room).Error; err != nil {
+		t.Fatal(err)
+	}
+	invite := &RoomInvite{RoomID: room.ID, CreatedBy: owner.ID, Nonce: "nonce", Role: RoomRoleMember, ExpiresAt: time.Now().Add(time.Hour)}
+	rows := []interface{}{
+		&RoomParticipant{RoomID: room.ID, UserID: owner.ID, Role: RoomRoleOwner, JoinedAt: time.Now()},
+		&RoomTag{RoomID: room.ID, Tag: "chat"},
+		invite,
+	}
+	for _, row := range rows {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodDelete, "/", nil), rec)
+	c.Set("user", owner)
+	c.Set("room", room)
+	if err := deleteRoomHandler(c, db, hub); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete = %d %s", rec.Code, rec.Body)
+	}
+	if event := <-hub.roomEvents; event.Kind != RoomEventDeleted || event.RoomID != "lobby" {
+		t.Fatalf("room event = %+v", event)
+	}
+
+	for _, model := range []interface{}{&ChatRoom{}, &RoomParticipant{}, &RoomTag{}, &RoomInvite{}} {
+		var count int64
+		query := db.Model(model)
+		if _, ok := model.(*ChatRoom); ok {
+			query = query.Where("id = ?", room.ID)
+		} else {
+			query = query.Where("room_id = ?", room.ID)
+		}
+		if err := query.Count(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Fatalf("%T rows left after deleting the room: %d", model, count)
+		}
+	}
+	if _, _, ok := findInvite(db, invite.Code()); ok {
+		t.Fatal("invite of the deleted room can still be found")
+	}
+}
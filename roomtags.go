@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	maxRoomTags           = 10
+	maxRoomTagLength      = 32
+	maxRoomDescriptionLen = 500
+	maxRoomTopicLen       = 200
+)
+
+var (
+	ErrInvalidTag   = errors.New("tags must be 1-32 characters of letters, digits and dashes, at most 10")
+	ErrRoomArchived = errors.New("archived rooms can't be changed, unarchive it first")
+)
+
+// RoomTag labels a room for discovery. Tags are stored normalized, see
+// normalizeTags
+type RoomTag struct {
+	RoomID uint   `gorm:"primaryKey"`
+	Tag    string `gorm:"primaryKey;size:32;index"`
+}
+
+// normalizeTag lowercases a tag, drops a leading # and turns spaces and
+// underscores into dashes, so "#Solana", "solana" and "SOLANA" are one tag
+func normalizeTag(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	tag = strings.TrimPrefix(tag, "#")
+	tag = strings.Join(strings.FieldsFunc(tag, func(r rune) bool { return r == ' ' || r == '_' }), "-")
+
+	if tag == "" || len(tag) > maxRoomTagLength {
+		return "", false
+	}
+	for _, r := range tag {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return "", false
+		}
+	}
+	return tag, true
+}
+
+// normalizeTags splits a comma separated tag list, normalizes and dedupes it
+func normalizeTags(raw string) ([]string, error) {
+	seen := make(map[string]bool)
+	tags := []string{}
+	for _, t := range strings.Split(raw, ",") {
+		if strings.TrimSpace(t) == "" {
+			continue
+		}
+		tag, ok := normalizeTag(t)
+		if !ok {
+			return nil, ErrInvalidTag
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxRoomTags {
+		return nil, ErrInvalidTag
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// setRoomTags replaces the tags of a room
+func setRoomTags(db *gorm.DB, roomID uint, tags []string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("room_id = ?", roomID).Delete(&RoomTag{}).Error; err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			if err := tx.Create(&RoomTag{RoomID: roomID, Tag: tag}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// roomTagNames returns the tags of each room in roomIDs with one query
+func roomTagNames(db *gorm.DB, roomIDs ...uint) map[uint][]string {
+	result := make(map[uint][]string, len(roomIDs))
+	if len(roomIDs) == 0 {
+		return result
+	}
+
+	var tags []RoomTag
+	db.Where("room_id IN ?", roomIDs).Order("tag").Find(&tags)
+	for _, t := range tags {
+		result[t.RoomID] = append(result[t.RoomID], t.Tag)
+	}
+	return result
+}
+
+func validRoomDescription(description string) bool {
+	return utf8.RuneCountInString(description) <= maxRoomDescriptionLen
+}
+
+// setRoomTopic changes the topic of a room and announces it to everyone in
+// it, an empty topic clears it. Archived rooms keep their topic
+func setRoomTopic(db *gorm.DB, hub *Hub, room *ChatRoom, actor *User, topic string) error {
+	if room.ArchivedAt != nil {
+		return ErrRoomArchived
+	}
+	topic = strings.TrimSpace(topic)
+	if utf8.RuneCountInString(topic) > maxRoomTopicLen {
+		return ErrInvalidInput
+	}
+
+	if err := db.Model(room).Update("topic", topic).Error; err != nil {
+		return err
+	}
+
+	message := actor.Username + " cleared the topic"
+	if topic != "" {
+		message = actor.Username + " changed the topic to: " + topic
+	}
+	hub.roomEvents <- &RoomEvent{
+		Kind:    RoomEventUpdated,
+		RoomID:  room.RoomID,
+		Message: message,
+	}
+	return nil
+}
+
+func setRoomTopicHandler(c echo.Context, db *gorm.DB, hub *Hub) error {
+	actor, room := contextUserAndRoom(c)
+
+	topic := c.FormValue("topic")
+	if err := setRoomTopic(db, hub, room, actor, topic); err != nil {
+		if errors.Is(err, ErrRoomArchived) {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": "Archived rooms can't be changed, unarchive it first",
+			})
+		}
+		if errors.Is(err, ErrInvalidInput) {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Topic must be at most 200 characters",
+			})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to update topic",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Topic updated",
+		"topic":   strings.TrimSpace(topic),
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetRoomTopic(t *testing.T) {
+	db := newTestDB(t)
+	hub := newHub(db)
+	hub.roomEvents = make(chan *RoomEvent, 4)
+	owner := createTestUser(t, db, "alice")
+	room := &ChatRoom{Name: "lobby", RoomID: "lobby", OwnerID: owner.ID, Topic: "old"}
+	if err := db.Create(room).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := setRoomTopic(db, hub, room, owner, "  new topic "); err != nil {
+		t.Fatal(err)
+	}
+	var stored ChatRoom
+	db.First(&stored, room.ID)
+	if stored.Topic != "new topic" {
+		t.Fatalf("topic = %q, want %q", stored.Topic, "new topic")
+	}
+	if event := <-hub.roomEvents; event.RoomID != "lobby" || event.Message != "alice changed the topic to: new topic" {
+		t.Fatalf("room event = %+v", event)
+	}
+
+	if err := setRoomTopic(db, hub, room, owner, strings.Repeat("x", maxRoomTopicLen+1)); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("long topic: err = %v, want ErrInvalidInput", err)
+	}
+
+	now := time.Now()
+	room.ArchivedAt = &now
+	if err := setRoomTopic(db, hub, room, owner, "archived"); !errors.Is(err, ErrRoomArchived) {
+		t.Fatalf("archived room: err = %v, want ErrRoomArchived", err)
+	}
+	db.First(&stored, room.ID)
+	if stored.Topic != "new topic" || len(hub.roomEvents) != 0 {
+		t.Fatalf("archived room topic changed to %q", stored.Topic)
+	}
+}
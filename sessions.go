@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	sessionTTL = 24 * time.Hour
+	// Don't write last_seen_at on every request
+	sessionTouchInterval = time.Minute
+)
+
+// Session is a login on one device, every session JWT carries the SessionID
+// of its record in the jti claim
+type Session struct {
+	gorm.Model
+	SessionID  string     `gorm:"size:32;uniqueIndex" json:"id"`
+	UserID     uint       `gorm:"index" json:"-"`
+	Device     string     `json:"device"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `gorm:"size:64" json:"ip"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+func createSession(c echo.Context, db *gorm.DB, user *User) (*Session, error) {
+	id, err := generateToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent := c.Request().UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+
+	now := time.Now()
+	session := &Session{
+		SessionID:  id,
+		UserID:     user.ID,
+		Device:     describeDevice(userAgent),
+		UserAgent:  userAgent,
+		IP:         c.RealIP(),
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(sessionTTL),
+	}
+	if err := db.Create(session).Error; err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// loadActiveSession returns the session for a JWT and records that it was seen
+func loadActiveSession(db *gorm.DB, sessionID string, userID uint) (*Session, error) {
+	if sessionID == "" {
+		return nil, ErrAuth
+	}
+
+	var session Session
+	if err := db.Where("session_id = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil {
+		return nil, ErrAuth
+	}
+
+	now := time.Now()
+	if !session.Active(now) {
+		return nil, ErrAuth
+	}
+
+	if now.Sub(session.LastSeenAt) > sessionTouchInterval {
+		db.Model(&session).Update("last_seen_at", now)
+	}
+	return &session, nil
+}
+
+// revokeSession marks the session revoked and disconnects its websockets
+func revokeSession(db *gorm.DB, hub *Hub, session *Session) error {
+	if err := db.Model(session).Update("revoked_at", time.Now()).Error; err != nil {
+		return err
+	}
+	hub.disconnectSession <- session.SessionID
+	return nil
+}
+
+// revokeUserSessions revokes every active session of a user, used after a
+// password reset
+func revokeUserSessions(db *gorm.DB, hub *Hub, userID uint) error {
+	var sessions []Session
+	if err := db.Where("user_id = ? AND revoked_at IS NULL", userID).Find(&sessions).Error; err != nil {
+		return err
+	}
+	for i := range sessions {
+		if err := revokeSession(db, hub, &sessions[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSessionID returns the session of the authenticated request, empty for
+// API tokens
+func GetSessionID(c echo.Context) string {
+	sessionID, ok := c.Get("session_id").(string)
+	if !ok {
+		return ""
+	}
+	return sessionID
+}
+
+// describeDevice turns a user agent into something like "Firefox on Linux"
+func describeDevice(userAgent string) string {
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	case strings.Contains(userAgent, "curl/"):
+		browser = "curl"
+	}
+
+	platform := "unknown OS"
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		platform = "Android"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		platform = "iOS"
+	case strings.Contains(userAgent, "Windows"):
+		platform = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		platform = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		platform = "Linux"
+	}
+
+	return browser + " on " + platform
+}
+
+func listSessionsHandler(c echo.Context, db *gorm.DB) error {
+	username := GetUsername(c)
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	var sessions []Session
+	if err := db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", user.ID, time.Now()).
+		Order("last_seen_at desc").
+		Find(&sessions).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch sessions",
+		})
+	}
+
+	current := GetSessionID(c)
+	response := make([]map[string]interface{}, 0, len(sessions))
+	for _, s := range sessions {
+		response = append(response, map[string]interface{}{
+			"id":           s.SessionID,
+			"device":       s.Device,
+			"user_agent":   s.UserAgent,
+			"ip":           s.IP,
+			"created_at":   s.CreatedAt,
+			"last_seen_at": s.LastSeenAt,
+			"expires_at":   s.ExpiresAt,
+			"current":      s.SessionID == current,
+		})
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func revokeSessionHandler(c echo.Context, db *gorm.DB, hub *Hub) error {
+	username := GetUsername(c)
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	var session Session
+	if err := db.Where("session_id = ? AND user_id = ? AND revoked_at IS NULL", c.Param("id"), user.ID).First(&session).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Session not found",
+		})
+	}
+
+	if err := revokeSession(db, hub, &session); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to revoke session",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Session revoked",
+	})
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	statsDayLayout = "2006-01-02"
+	// Flush early when this many users have pending counters
+	maxPendingStatsUsers = 10000
+	statsHistoryDays     = 30
+)
+
+// UserStats holds the lifetime counters of a user
+type UserStats struct {
+	UserID        uint      `gorm:"primaryKey" json:"-"`
+	MessagesSent  int64     `gorm:"index" json:"messages_sent"`
+	RoomsJoined   int64     `json:"rooms_joined"`
+	ActiveDays    int64     `json:"active_days"`
+	CurrentStreak int64     `json:"current_streak"`
+	LongestStreak int64     `gorm:"index" json:"longest_streak"`
+	LastActiveDay string    `gorm:"size:10" json:"last_active_day"` // UTC, YYYY-MM-DD
+	UpdatedAt     time.Time `json:"-"`
+}
+
+// UserDailyActivity counts the messages a user sent on one UTC day
+type UserDailyActivity struct {
+	UserID   uint   `gorm:"primaryKey" json:"-"`
+	Day      string `gorm:"primaryKey;size:10" json:"day"`
+	Messages int64  `json:"messages"`
+}
+
+// UserRoomActivity counts the messages a user sent in one room on one UTC day
+type UserRoomActivity struct {
+	UserID   uint   `gorm:"primaryKey" json:"-"`
+	RoomID   string `gorm:"primaryKey;size:32;index" json:"room_id"`
+	Day      string `gorm:"primaryKey;size:10;index" json:"day"`
+	Messages int64  `json:"messages"`
+}
+
+// streakOn returns the streak as of day, a streak ends once a whole day
+// passes without activity
+func (s *UserStats) streakOn(day string) int64 {
+	if s.LastActiveDay == "" {
+		return 0
+	}
+	if s.LastActiveDay == day || s.LastActiveDay == previousDay(day) {
+		return s.CurrentStreak
+	}
+	return 0
+}
+
+// addDay records activity on day, days must be added in order
+func (s *UserStats) addDay(day string) {
+	if day <= s.LastActiveDay {
+		return
+	}
+	if s.LastActiveDay != "" && s.LastActiveDay == previousDay(day) {
+		s.CurrentStreak++
+	} else {
+		s.CurrentStreak = 1
+	}
+	s.ActiveDays++
+	s.LastActiveDay = day
+	s.LongestStreak = max(s.LongestStreak, s.CurrentStreak)
+}
+
+func previousDay(day string) string {
+	t, err := time.Parse(statsDayLayout, day)
+	if err != nil {
+		return ""
+	}
+	return t.AddDate(0, 0, -1).Format(statsDayLayout)
+}
+
+// StatsService counts user activity. Recording only touches memory, the
+// counters are written to the database in batches by Flush
+type StatsService interface {
+	MetricSource
+	RecordMessage(userID uint, roomID string, at time.Time)
+	RecordRoomJoined(userID uint)
+	// Flush writes the pending counters, Run calls it periodically
+	Flush() error
+	Run(interval time.Duration)
+	// Get returns the stats of a user including counters not flushed yet
+	Get(userID uint) (UserStats, error)
+}
+
+type roomDay struct {
+	roomID string
+	day    string
+}
+
+type pendingStats struct {
+	messages    int64
+	roomsJoined int64
+	days        map[string]int64  // messages per day
+	roomDays    map[roomDay]int64 // messages per room and day
+}
+
+type statsService struct {
+	db *gorm.DB
+
+	mu      sync.Mutex
+	pending map[uint]*pendingStats
+
+	// serializes flushes, pending may keep filling meanwhile
+	flushMu sync.Mutex
+}
+
+func NewStatsService(db *gorm.DB) StatsService {
+	return &statsService{
+		db:      db,
+		pending: make(map[uint]*pendingStats),
+	}
+}
+
+func (s *statsService) entry(userID uint) *pendingStats {
+	p, ok := s.pending[userID]
+	if !ok {
+		p = &pendingStats{days: make(map[string]int64), roomDays: make(map[roomDay]int64)}
+		s.pending[userID] = p
+	}
+	return p
+}
+
+func (s *statsService) RecordMessage(userID uint, roomID string, at time.Time) {
+	day := at.UTC().Format(statsDayLayout)
+
+	s.mu.Lock()
+	p := s.entry(userID)
+	p.messages++
+	p.days[day]++
+	if roomID != "" {
+		p.roomDays[roomDay{roomID: roomID, day: day}]++
+	}
+	full := len(s.pending) >= maxPendingStatsUsers
+	s.mu.Unlock()
+
+	if full {
+		go s.flushAndLog()
+	}
+}
+
+func (s *statsService) RecordRoomJoined(userID uint) {
+	s.mu.Lock()
+	s.entry(userID).roomsJoined++
+	s.mu.Unlock()
+}
+
+func (s *statsService) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.flushAndLog()
+	}
+}
+
+func (s *statsService) flushAndLog() {
+	if err := s.Flush(); err != nil {
+		slog.Error("failed to flush stats", "error", err)
+	}
+}
+
+func (s *statsService) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = make(map[uint]*pendingStats, len(batch))
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var streakChanged []uint
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for userID, p := range batch {
+			days := sortedDays(p.days)
+			for _, day := range days {
+				if err := tx.Clauses(clause.OnConflict{
+					DoUpdates: clause.Assignments(map[string]interface{}{"messages": gorm.Expr("messages + ?", p.days[day])}),
+				}).Create(&UserDailyActivity{UserID: userID, Day: day, Messages: p.days[day]}).Error; err != nil {
+					return err
+				}
+			}
+			for key, n := range p.roomDays {
+				if err := tx.Clauses(clause.OnConflict{
+					DoUpdates: clause.Assignments(map[string]interface{}{"messages": gorm.Expr("messages + ?", n)}),
+				}).Create(&UserRoomActivity{UserID: userID, RoomID: key.roomID, Day: key.day, Messages: n}).Error; err != nil {
+					return err
+				}
+			}
+
+			var row UserStats
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				FirstOrCreate(&row, UserStats{UserID: userID}).Error; err != nil {
+				return err
+			}
+			before := row.ActiveDays
+			row.MessagesSent += p.messages
+			row.RoomsJoined += p.roomsJoined
+			for _, day := range days {
+				row.addDay(day)
+			}
+			if err := tx.Save(&row).Error; err != nil {
+				return err
+			}
+			if row.ActiveDays != before {
+				streakChanged = append(streakChanged, userID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Put the counters back so they aren't lost
+		s.mu.Lock()
+		for userID, p := range batch {
+			dst := s.entry(userID)
+			dst.messages += p.messages
+			dst.roomsJoined += p.roomsJoined
+			for day, n := range p.days {
+				dst.days[day] += n
+			}
+			for key, n := range p.roomDays {
+				dst.roomDays[key] += n
+			}
+		}
+		s.mu.Unlock()
+		return err
+	}
+
+	invalidateLeaderboards()
+
+	for _, userID := range streakChanged {
+		publishAchievementEvent(userID, MetricActiveDays, MetricStreakDays)
+	}
+	return nil
+}
+
+func sortedDays(days map[string]int64) []string {
+	sorted := make([]string, 0, len(days))
+	for day := range days {
+		sorted = append(sorted, day)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func (s *statsService) Get(userID uint) (UserStats, error) {
+	row := UserStats{UserID: userID}
+	if err := s.db.Where("user_id = ?", userID).Limit(1).Find(&row).Error; err != nil {
+		return row, err
+	}
+
+	s.mu.Lock()
+	if p, ok := s.pending[userID]; ok {
+		row.MessagesSent += p.messages
+		row.RoomsJoined += p.roomsJoined
+		for _, day := range sortedDays(p.days) {
+			row.addDay(day)
+		}
+	}
+	s.mu.Unlock()
+
+	row.CurrentStreak = row.streakOn(time.Now().UTC().Format(statsDayLayout))
+	return row, nil
+}
+
+func (s *statsService) Metrics(user *User, names []string) (map[string]int64, error) {
+	row, err := s.Get(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]int64, len(names))
+	for _, name := range names {
+		switch name {
+		case MetricMessagesSent:
+			values[name] = row.MessagesSent
+		case MetricActiveDays:
+			values[name] = row.ActiveDays
+		case MetricStreakDays:
+			values[name] = row.CurrentStreak
+		}
+	}
+	return values, nil
+}
+
+var stats StatsService
+
+// incrementMessagesSent counts a chat message user sent in roomID, it is
+// called from the hub's broadcast path and never touches the database itself
+func incrementMessagesSent(user *User, roomID string) {
+	if stats == nil || user == nil {
+		return
+	}
+	stats.RecordMessage(user.ID, roomID, time.Now())
+	publishAchievementEvent(user.ID, MetricMessagesSent)
+}
+
+// incrementRoomsJoined counts a room the user became a participant of
+func incrementRoomsJoined(user *User) {
+	if stats == nil {
+		return
+	}
+	stats.RecordRoomJoined(user.ID)
+}
+
+func getUserStatsHandler(c echo.Context, db *gorm.DB) error {
+	var user User
+	if err := db.Where("username = ?", c.Param("username")).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	row, err := stats.Get(user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch stats",
+		})
+	}
+
+	since := time.Now().UTC().AddDate(0, 0, -statsHistoryDays).Format(statsDayLayout)
+	activity := []UserDailyActivity{}
+	if err := db.Where("user_id = ? AND day > ?", user.ID, since).Order("day").Find(&activity).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch stats",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"username": user.Username,
+		"stats":    row,
+		"activity": activity,
+	})
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	totpPeriod   = 30
+	totpDigits   = 6
+	totpSkew     = 1 // number of periods accepted before and after the current one
+	totpIssuer   = "auth-chat"
+	recoveryKeys = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// RecoveryCode is a one time code that can replace a TOTP code, only the hash
+// is stored
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"index"`
+	CodeHash string `gorm:"size:64;index"`
+	UsedAt   *time.Time
+}
+
+func generateTOTPSecret() (string, error) {
+	bytes := make([]byte, 20)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(bytes), nil
+}
+
+// totpCode computes the RFC 6238 code of secret for the given time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// verifyTOTP checks code against the steps around now and returns the
+// matching step. Steps at or before lastStep are rejected so a code can't be
+// replayed
+func verifyTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(secret, username string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("period", fmt.Sprint(totpPeriod))
+	q.Set("digits", fmt.Sprint(totpDigits))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// checkUserTOTP verifies a code for an enrolled user and records the used step
+func checkUserTOTP(db *gorm.DB, user *User, code string) bool {
+	step, ok := verifyTOTP(user.TOTPSecret, code, user.TOTPLastStep, time.Now())
+	if !ok {
+		return false
+	}
+
+	// Conditional update so the same code can't be used twice concurrently
+	result := db.Model(&User{}).
+		Where("id = ? AND totp_last_step < ?", user.ID, step).
+		Update("totp_last_step", step)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+	user.TOTPLastStep = step
+	return true
+}
+
+// generateRecoveryCodes replaces the user's recovery codes and returns the new
+// plain codes, they can't be shown again afterwards
+func generateRecoveryCodes(db *gorm.DB, userID uint) ([]string, error) {
+	codes := make([]string, 0, recoveryKeys)
+	records := make([]RecoveryCode, 0, recoveryKeys)
+	for i := 0; i < recoveryKeys; i++ {
+		bytes := make([]byte, 5)
+		if _, err := rand.Read(bytes); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(bytes))
+		code := raw[:4] + "-" + raw[4:]
+		codes = append(codes, code)
+		records = append(records, RecoveryCode{
+			UserID:   userID,
+			CodeHash: hashToken(code),
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func useRecoveryCode(db *gorm.DB, userID uint, code string) bool {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if code == "" {
+		return false
+	}
+	result := db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(code)).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected > 0
+}
+
+func enrollTOTPHandler(c echo.Context, db *gorm.DB) error {
+	username := GetUsername(c)
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	if user.TOTPEnabled {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Two-factor authentication is already enabled",
+		})
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to generate secret",
+		})
+	}
+
+	if err := db.Model(&user).Updates(map[string]interface{}{
+		"totp_secret":    secret,
+		"totp_last_step": 0,
+	}).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to start enrollment",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"secret":      secret,
+		"otpauth_url": totpURI(secret, user.Username),
+	})
+}
+
+func confirmTOTPHandler(c echo.Context, db *gorm.DB) error {
+	username := GetUsername(c)
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	if user.TOTPEnabled {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Two-factor authentication is already enabled",
+		})
+	}
+	if user.TOTPSecret == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Start enrollment first",
+		})
+	}
+
+	if !checkUserTOTP(db, &user, c.FormValue("code")) {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Invalid code",
+		})
+	}
+
+	codes, err := generateRecoveryCodes(db, user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to generate recovery codes",
+		})
+	}
+
+	if err := db.Model(&user).Update("totp_enabled", true).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to enable two-factor authentication",
+		})
+	}
+	publishAchievementEvent(user.ID, MetricTwoFactor)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+func disableTOTPHandler(c echo.Context, db *gorm.DB) error {
+	username := GetUsername(c)
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	if !user.TOTPEnabled {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Two-factor authentication is not enabled",
+		})
+	}
+
+	// The password check goes through the login guard like a login, or this
+	// would be a way to guess passwords without backoff
+	if allowed, err := checkLoginAllowed(c, db, user.Email); !allowed {
+		return err
+	}
+	passwordOK, _, err := verifyPassword(c.FormValue("password"), user.HashedPassword)
+	if err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": "The server is busy, please try again",
+		})
+	}
+	if !passwordOK || !checkUserTOTP(db, &user, c.FormValue("code")) {
+		recordLoginFailure(c, db, user.Email, &user)
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Invalid password or code",
+		})
+	}
+	recordLoginSuccess(user.Email)
+
+	if err := resetTOTP(db, user.ID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to disable two-factor authentication",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+func regenerateRecoveryCodesHandler(c echo.Context, db *gorm.DB) error {
+	username := GetUsername(c)
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	if !user.TOTPEnabled {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Two-factor authentication is not enabled",
+		})
+	}
+
+	if !checkUserTOTP(db, &user, c.FormValue("code")) {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Invalid code",
+		})
+	}
+
+	codes, err := generateRecoveryCodes(db, user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to generate recovery codes",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+// loginMFAHandler is the second step of the login for users with 2FA, it
+// trades the mfa pending token and a code for the real JWT
+func loginMFAHandler(c echo.Context, db *gorm.DB) error {
+	claims, err := ValidateMFAToken(c.FormValue("mfa_token"))
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Invalid or expired login attempt, please log in again",
+		})
+	}
+
+	var user User
+	if err := db.Where("username = ?", claims.Username).First(&user).Error; err != nil || !user.TOTPEnabled {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Invalid or expired login attempt, please log in again",
+		})
+	}
+
+	if allowed, err := checkLoginAllowed(c, db, user.Email); !allowed {
+		return err
+	}
+
+	ok := false
+	if code := c.FormValue("code"); code != "" {
+		ok = checkUserTOTP(db, &user, code)
+	} else if recoveryCode := c.FormValue("recovery_code"); recoveryCode != "" {
+		ok = useRecoveryCode(db, user.ID, recoveryCode)
+	}
+	if !ok {
+		recordLoginFailure(c, db, user.Email, &user)
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Invalid code",
+		})
+	}
+
+	recordLoginSuccess(user.Email)
+	return issueLoginToken(c, db, &user)
+}
+
+func adminResetTOTPHandler(c echo.Context, db *gorm.DB) error {
+	var user User
+	if err := db.Where("username = ?", c.Param("username")).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	if err := resetTOTP(db, user.ID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to reset two-factor authentication",
+		})
+	}
+
+	recordAudit(db, AuditTOTPReset, &user, c.RealIP(), "reset by "+GetUsername(c))
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Two-factor authentication reset",
+	})
+}
+
+func resetTOTP(db *gorm.DB, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"totp_enabled":   false,
+			"totp_secret":    "",
+			"totp_last_step": 0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+	})
+}
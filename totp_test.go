@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed of the RFC 6238 test vectors,
+// "12345678901234567890" in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// The RFC lists 8 digit codes, 6 digit codes are their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.want[len(tt.want)-totpDigits:]; got != want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestTOTPCodeLowercaseSecret(t *testing.T) {
+	upper, _ := totpCode(rfc6238Secret, 1)
+	lower, err := totpCode("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 1)
+	if err != nil || lower != upper {
+		t.Fatalf("lowercase secret gave %q, %v, want %q", lower, err, upper)
+	}
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Fatal("invalid secret was accepted")
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	code, _ := totpCode(rfc6238Secret, current)
+
+	step, ok := verifyTOTP(rfc6238Secret, " "+code+" ", 0, now)
+	if !ok || step != current {
+		t.Fatalf("verifyTOTP = %d, %v, want %d, true", step, ok, current)
+	}
+
+	// One period of clock skew either way is accepted, two are not
+	for offset, want := range map[int64]bool{-2: false, -1: true, 1: true, 2: false} {
+		code, _ := totpCode(rfc6238Secret, current+offset)
+		if _, ok := verifyTOTP(rfc6238Secret, code, 0, now); ok != want {
+			t.Errorf("code %d steps away accepted = %v, want %v", offset, ok, want)
+		}
+	}
+
+	for _, bad := range []string{"", "12345", "1234567", "000000"} {
+		if bad == code {
+			continue
+		}
+		if _, ok := verifyTOTP(rfc6238Secret, bad, 0, now); ok {
+			t.Errorf("verifyTOTP accepted %q", bad)
+		}
+	}
+}
+
+func TestVerifyTOTPRejectsReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, _ := totpCode(rfc6238Secret, now.Unix()/totpPeriod)
+
+	step, ok := verifyTOTP(rfc6238Secret, code, 0, now)
+	if !ok {
+		t.Fatal("first use of the code was rejected")
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, code, step, now); ok {
+		t.Fatal("the same code was accepted twice")
+	}
+	// Still rejected within the skew window of the next period
+	if _, ok := verifyTOTP(rfc6238Secret, code, step, now.Add(totpPeriod*time.Second)); ok {
+		t.Fatal("the code was accepted again in the next period")
+	}
+
+	// An older code is rejected once a later step was used
+	older, _ := totpCode(rfc6238Secret, step-1)
+	if _, ok := verifyTOTP(rfc6238Secret, older, step, now); ok {
+		t.Fatal("a code older than the last used step was accepted")
+	}
+}
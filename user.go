@@ -1,12 +1,34 @@
 package main
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
 type User struct {
 	gorm.Model
-	HashedPassword string
-	Username       string
-	Email          string
+	HashedPassword  string
+	Username        string
+	Email           string
+	EmailVerified   bool
+	EmailVerifiedAt *time.Time
+	Role            string `gorm:"size:16;default:user"`
+
+	// Two-factor authentication
+	TOTPSecret   string `json:"-"`
+	TOTPEnabled  bool
+	TOTPLastStep int64 `json:"-"`
+
+	// Random WebAuthn user handle, set when the first passkey is registered
+	PasskeyHandle string `gorm:"size:64;index" json:"-"`
+
+	Achievements []UserAchievement `gorm:"foreignKey:UserID" json:"achievements,omitempty"`
+
+	// Post "alice unlocked Chatterbox" to the rooms the user is in
+	AnnounceAchievements bool `gorm:"default:false"`
+}
+
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
 }
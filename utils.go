@@ -1,23 +1,52 @@
 package main
 
 import (
-	"golang.org/x/crypto/bcrypt"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 )
 
 func hashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	return string(bytes), err
+	var hash string
+	var err error
+	if poolErr := passwordPool.do(func() {
+		hash, err = passwordHasher.Hash(password)
+	}); poolErr != nil {
+		return "", poolErr
+	}
+	return hash, err
 }
 
 func checkPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+	ok, _, _ := verifyPassword(password, hash)
+	return ok
 }
 
-// func generateToken(length int) string {
-// 	bytes := make([]byte, length)
-// 	if _, err := rand.Read(bytes); err != nil {
-// 		log.Fatalf("failed to generate token: %v", err)
-// 	}
-// 	return base64.URLEncoding.EncodeToString(bytes)
-// }
+// verifyPassword checks a password and also reports whether the hash should
+// be replaced because the hasher settings changed since it was made. The
+// error is ErrHasherBusy when no hashing slot came free, the password was
+// not checked then
+func verifyPassword(password, hash string) (ok bool, needsRehash bool, err error) {
+	if poolErr := passwordPool.do(func() {
+		ok, _ = verifyEncodedPassword(password, hash)
+	}); poolErr != nil {
+		return false, false, poolErr
+	}
+	return ok, ok && passwordHasher.NeedsRehash(hash), nil
+}
+
+// generateToken returns a url safe random token built from length random bytes
+func generateToken(length int) (string, error) {
+	bytes := make([]byte, length)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// hashToken returns the hex sha256 of a token so only the digest has to be stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposePasswordReset = "password_reset"
+
+	verifyEmailTokenTTL   = 24 * time.Hour
+	passwordResetTokenTTL = time.Hour
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// UserToken is a single use token mailed to a user, only the hash is stored
+type UserToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	Purpose   string `gorm:"size:32;index"`
+	TokenHash string `gorm:"size:64;uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// UnverifiedPolicy controls what accounts without a verified email can do
+type UnverifiedPolicy struct {
+	CanLogin      bool
+	CanCreateRoom bool
+	CanJoinRoom   bool
+}
+
+var unverifiedPolicy = UnverifiedPolicy{
+	CanLogin:      true,
+	CanCreateRoom: false,
+	CanJoinRoom:   true,
+}
+
+// appBaseURL is used to build the links sent in emails
+var appBaseURL = "http://localhost:8080"
+
+func LoadUnverifiedPolicy() UnverifiedPolicy {
+	policy := unverifiedPolicy
+	policy.CanLogin = envBool("UNVERIFIED_CAN_LOGIN", policy.CanLogin)
+	policy.CanCreateRoom = envBool("UNVERIFIED_CAN_CREATE_ROOM", policy.CanCreateRoom)
+	policy.CanJoinRoom = envBool("UNVERIFIED_CAN_JOIN_ROOM", policy.CanJoinRoom)
+	return policy
+}
+
+func envBool(key string, fallback bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+// createUserToken invalidates any outstanding token with the same purpose and
+// returns a fresh one, the raw token is never written to the database
+func createUserToken(db *gorm.DB, userID uint, purpose string, ttl time.Duration) (string, error) {
+	token, err := generateToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&UserToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+			Update("used_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Create(&UserToken{
+			UserID:    userID,
+			Purpose:   purpose,
+			TokenHash: hashToken(token),
+			ExpiresAt: now.Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// findUserToken looks up a token that is still usable and returns it with
+// its owner without using it up
+func findUserToken(db *gorm.DB, token, purpose string) (*UserToken, *User, error) {
+	if token == "" {
+		return nil, nil, ErrInvalidToken
+	}
+
+	var userToken UserToken
+	if err := db.Where("token_hash = ? AND purpose = ?", hashToken(token), purpose).First(&userToken).Error; err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+
+	if userToken.UsedAt != nil || time.Now().After(userToken.ExpiresAt) {
+		return nil, nil, ErrInvalidToken
+	}
+
+	var user User
+	if err := db.First(&user, userToken.UserID).Error; err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+	return &userToken, &user, nil
+}
+
+// markUserTokenUsed uses up the token. The update is conditional so two
+// requests racing with the same token can't both succeed
+func markUserTokenUsed(db *gorm.DB, userToken *UserToken) error {
+	result := db.Model(&UserToken{}).
+		Where("id = ? AND used_at IS NULL", userToken.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil || result.RowsAffected == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// consumeUserToken marks the token as used and returns its owner
+func consumeUserToken(db *gorm.DB, token, purpose string) (*User, error) {
+	userToken, user, err := findUserToken(db, token, purpose)
+	if err != nil {
+		return nil, err
+	}
+	if err := markUserTokenUsed(db, userToken); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func sendVerificationEmail(db *gorm.DB, user *User) error {
+	token, err := createUserToken(db, user.ID, TokenPurposeVerifyEmail, verifyEmailTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link := appBaseURL + "/verify-email?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hi %s,\n\nConfirm your email address by opening the link below:\n\n%s\n\nThe link expires in 24 hours.\n", user.Username, link)
+	return mailer.Send(user.Email, "Verify your email", body)
+}
+
+func sendPasswordResetEmail(db *gorm.DB, user *User) error {
+	token, err := createUserToken(db, user.ID, TokenPurposePasswordReset, passwordResetTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link := appBaseURL + "/reset-password?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. If it was you, open the link below:\n\n%s\n\nThe link expires in 1 hour. If you didn't ask for this you can ignore this email.\n", user.Username, link)
+	return mailer.Send(user.Email, "Reset your password", body)
+}
+
+func verifyEmailHandler(c echo.Context, db *gorm.DB) error {
+	user, err := consumeUserToken(db, c.QueryParam("token"), TokenPurposeVerifyEmail)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid or expired verification link",
+		})
+	}
+
+	now := time.Now()
+	if err := db.Model(user).Updates(map[string]interface{}{
+		"email_verified":    true,
+		"email_verified_at": now,
+	}).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to verify email",
+		})
+	}
+	publishAchievementEvent(user.ID, MetricEmailVerified)
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Email verified",
+	})
+}
+
+func resendVerificationHandler(c echo.Context, db *gorm.DB) error {
+	username := GetUsername(c)
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "User not found",
+		})
+	}
+
+	if user.EmailVerified {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Email is already verified",
+		})
+	}
+
+	if err := sendVerificationEmail(db, &user); err != nil {
+		log.Printf("failed to send verification email to %s: %v", user.Username, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to send verification email",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Verification email sent",
+	})
+}
+
+func forgotPasswordHandler(c echo.Context, db *gorm.DB) error {
+	email := c.FormValue("email")
+
+	// Always answer the same way so this can't be used to find out which
+	// emails have an account
+	response := map[string]string{
+		"message": "If an account exists for that email, a reset link has been sent",
+	}
+
+	var user User
+	if email == "" || db.Where("email = ?", email).First(&user).Error != nil {
+		return c.JSON(http.StatusOK, response)
+	}
+
+	if err := sendPasswordResetEmail(db, &user); err != nil {
+		log.Printf("failed to send password reset email to %s: %v", user.Username, err)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func resetPasswordHandler(c echo.Context, db *gorm.DB, hub *Hub) error {
+	password := c.FormValue("password")
+
+	userToken, user, err := findUserToken(db, c.FormValue("token"), TokenPurposePasswordReset)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid or expired reset link",
+		})
+	}
+
+	// Validate before using up the token so the user can try another password
+	if fieldErrors := passwordPolicy.Validate(password, user.Username, user.Email); len(fieldErrors) > 0 {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":  "Invalid password",
+			"fields": fieldErrors,
+		})
+	}
+
+	if err := markUserTokenUsed(db, userToken); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid or expired reset link",
+		})
+	}
+
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to hash password",
+		})
+	}
+
+	// The user proved they own the mailbox, so the email counts as verified too
+	if err := db.Model(user).Updates(map[string]interface{}{
+		"hashed_password": hashedPassword,
+		"email_verified":  true,
+	}).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to reset password",
+		})
+	}
+
+	// Whoever knew the old password shouldn't stay logged in
+	if err := revokeUserSessions(db, hub, user.ID); err != nil {
+		log.Printf("failed to revoke sessions of %s after password reset: %v", user.Username, err)
+	}
+	if err := revokeUserAPITokens(db, user.ID); err != nil {
+		log.Printf("failed to revoke API tokens of %s after password reset: %v", user.Username, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Password has been reset",
+	})
+}
+
+// verifiedOrAllowed reports whether the user can do something that the
+// UnverifiedPolicy may restrict
+func verifiedOrAllowed(user *User, allowed bool) bool {
+	return allowed || user.EmailVerified
+}
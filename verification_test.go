@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var mailedToken = regexp.MustCompile(`token=([^\s]+)`)
+
+// captureMail swaps in a log mailer for the test and returns what it wrote
+func captureMail(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	saved := mailer
+	mailer = NewLogMailer(&buf)
+	t.Cleanup(func() { mailer = saved })
+	return &buf
+}
+
+// lastMailedToken returns the token of the last link in the captured mails
+func lastMailedToken(t *testing.T, mail *bytes.Buffer) string {
+	t.Helper()
+	matches := mailedToken.FindAllStringSubmatch(mail.String(), -1)
+	if len(matches) == 0 {
+		t.Fatalf("no token in mail:\n%s", mail)
+	}
+	token, err := url.QueryUnescape(matches[len(matches)-1][1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerifyEmailTokenSingleUse(t *testing.T) {
+	db := newTestDB(t)
+	mail := captureMail(t)
+	user := createTestUser(t, db, "alice")
+
+	if err := sendVerificationEmail(db, user); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(mail.String(), "To: alice@example.com") {
+		t.Fatalf("mail not sent to the user:\n%s", mail)
+	}
+	token := lastMailedToken(t, mail)
+
+	verify := func() int {
+		e := echo.New()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/verify-email?token="+url.QueryEscape(token), nil)
+		if err := verifyEmailHandler(e.NewContext(req, rec), db); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code
+	}
+	if code := verify(); code != http.StatusOK {
+		t.Fatalf("first verification = %d, want 200", code)
+	}
+	var verified User
+	db.First(&verified, user.ID)
+	if !verified.EmailVerified || verified.EmailVerifiedAt == nil {
+		t.Fatalf("user after verification = %+v", verified)
+	}
+	if code := verify(); code != http.StatusBadRequest {
+		t.Fatalf("second verification = %d, want 400", code)
+	}
+}
+
+func TestConsumeUserToken(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "alice")
+
+	token, err := createUserToken(db, user.ID, TokenPurposeVerifyEmail, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := consumeUserToken(db, token, TokenPurposePasswordReset); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("token used for another purpose: err = %v", err)
+	}
+	got, err := consumeUserToken(db, token, TokenPurposeVerifyEmail)
+	if err != nil || got.ID != user.ID {
+		t.Fatalf("first consume = %v, %v", got, err)
+	}
+	if _, err := consumeUserToken(db, token, TokenPurposeVerifyEmail); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("second consume: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := consumeUserToken(db, "", TokenPurposeVerifyEmail); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("empty token: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestConsumeUserTokenExpired(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "alice")
+
+	token, err := createUserToken(db, user.ID, TokenPurposePasswordReset, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&UserToken{}).Where("user_id = ?", user.ID).Update("expires_at", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := consumeUserToken(db, token, TokenPurposePasswordReset); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expired token: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestCreateUserTokenReplacesOutstanding(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "alice")
+
+	old, err := createUserToken(db, user.ID, TokenPurposeVerifyEmail, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := createUserToken(db, user.ID, TokenPurposeVerifyEmail, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := consumeUserToken(db, old, TokenPurposeVerifyEmail); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("replaced token: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := consumeUserToken(db, fresh, TokenPurposeVerifyEmail); err != nil {
+		t.Fatalf("fresh token: %v", err)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	db := newTestDB(t)
+	mail := captureMail(t)
+	savedHasher := passwordHasher
+	passwordHasher = NewBcryptHasher(bcrypt.MinCost)
+	t.Cleanup(func() { passwordHasher = savedHasher })
+
+	user := createTestUser(t, db, "alice")
+	apiToken := &APIToken{UserID: user.ID, Name: "bot", TokenHash: "hash", Scopes: ScopeProfileRead}
+	if err := db.Create(apiToken).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := sendPasswordResetEmail(db, user); err != nil {
+		t.Fatal(err)
+	}
+	token := lastMailedToken(t, mail)
+
+	reset := func(password string) int {
+		e := echo.New()
+		form := url.Values{"token": {token}, "password": {password}}
+		req := httptest.NewRequest(http.MethodPost, "/reset-password", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		if err := resetPasswordHandler(e.NewContext(req, rec), db, newHub(db)); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code
+	}
+
+	// A rejected password leaves the token usable
+	if code := reset("short"); code != http.StatusBadRequest {
+		t.Fatalf("weak password = %d, want 400", code)
+	}
+	if code := reset("plum violin 47 kite"); code != http.StatusOK {
+		t.Fatalf("reset = %d, want 200", code)
+	}
+	var updated User
+	db.First(&updated, user.ID)
+	if !checkPasswordHash("plum violin 47 kite", updated.HashedPassword) || !updated.EmailVerified {
+		t.Fatalf("user after reset = %+v", updated)
+	}
+	db.First(apiToken, apiToken.ID)
+	if apiToken.RevokedAt == nil {
+		t.Fatal("API token survived the password reset")
+	}
+	if code := reset("another plum violin 48"); code != http.StatusBadRequest {
+		t.Fatalf("reusing the reset link = %d, want 400", code)
+	}
+}